@@ -0,0 +1,199 @@
+package btree
+
+import (
+	"slices"
+)
+
+// the InsertBatch() without the size checks and the commit.
+// the KVs are sorted and routed down the tree together, so each affected
+// node is rebuilt once no matter how many of the KVs land in it
+func (tree *BTree) insertBatch(kvs []KV) {
+	if len(kvs) == 0 {
+		return
+	}
+	kvs = sortKVs(tree, slices.Clone(kvs))
+
+	keys := make([][]byte, len(kvs))
+	vals := make([][]byte, len(kvs))
+	vptrs := make([]uint64, len(kvs))
+	for i, kv := range kvs {
+		keys[i], vals[i] = kv.Key, tree.valEncode(kv.Val)
+		if len(vals[i]) > BTREE_MAX_VAL_SIZE {
+			vptrs[i], vals[i] = tree.overflowWrite(vals[i])
+		}
+	}
+
+	var root BNode
+	if tree.root == 0 {
+		// the first leaf only has the dummy key
+		root = BNode(make([]byte, tree.pageSize()))
+		root.setHeader(BNODE_LEAF|tree.leafFlags(), 1)
+		nodeAppendKV(root, 0, 0, nil, nil)
+	} else {
+		root = tree.get(tree.root)
+	}
+
+	nodes := treeInsertBatch(tree, root, keys, vals, vptrs)
+	if tree.root != 0 {
+		tree.del(tree.root)
+	}
+	// add levels until a single root is left
+	for len(nodes) > 1 {
+		flags := tree.nodeFlags(nodes[0])
+		keys := make([][]byte, len(nodes))
+		vals := make([][]byte, len(nodes))
+		ptrs := make([]uint64, len(nodes))
+		for i, node := range nodes {
+			keys[i], vals[i], ptrs[i] = node.getKey(0), kidCountVal(flags, node), tree.new(node)
+		}
+		nodes = nodePack(tree, BNODE_NODE|flags, keys, vals, ptrs)
+	}
+	tree.root = tree.new(nodes[0])
+}
+
+// sort KVs by key in place, dropping all but the last KV of each key
+// as if the KVs were inserted in order
+func sortKVs(tree *BTree, kvs []KV) []KV {
+	slices.SortStableFunc(kvs, func(a KV, b KV) int {
+		return tree.compare(a.Key, b.Key)
+	})
+	n := 0
+	for i := range kvs {
+		if i+1 < len(kvs) && tree.compare(kvs[i].Key, kvs[i+1].Key) == 0 {
+			continue
+		}
+		kvs[n] = kvs[i]
+		n++
+	}
+	return kvs[:n]
+}
+
+// insert sorted KVs into a subtree, returning the nodes replacing it
+func treeInsertBatch(
+	tree *BTree, node BNode,
+	keys [][]byte, vals [][]byte, vptrs []uint64,
+) []BNode {
+	n := int(node.nkeys()) + len(keys)
+	newKeys := make([][]byte, 0, n)
+	newVals := make([][]byte, 0, n)
+	newPtrs := make([]uint64, 0, n)
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		// merge the KVs into the leaf, replacing the values of existing keys
+		i := 0
+		for idx := uint16(0); idx < node.nkeys(); idx++ {
+			key := node.getKey(idx)
+			for ; i < len(keys) && tree.compare(keys[i], key) < 0; i++ {
+				newKeys, newVals, newPtrs = append(newKeys, keys[i]), append(newVals, vals[i]), append(newPtrs, vptrs[i])
+			}
+			if i < len(keys) && tree.compare(keys[i], key) == 0 {
+				if vptr := node.getPtr(idx); vptr != 0 {
+					tree.overflowFree(vptr)
+				}
+				newKeys, newVals, newPtrs = append(newKeys, keys[i]), append(newVals, vals[i]), append(newPtrs, vptrs[i])
+				i++
+				continue
+			}
+			newKeys, newVals, newPtrs = append(newKeys, key), append(newVals, node.getVal(idx)), append(newPtrs, node.getPtr(idx))
+		}
+		for ; i < len(keys); i++ {
+			newKeys, newVals, newPtrs = append(newKeys, keys[i]), append(newVals, vals[i]), append(newPtrs, vptrs[i])
+		}
+		tree.count += len(newKeys) - int(node.nkeys())
+		if tree.obs != nil {
+			for range keys {
+				tree.obs.OnInsert()
+			}
+		}
+		nodes := nodePack(tree, BNODE_LEAF|node.flags(), newKeys, newVals, newPtrs)
+		tree.observeSplit(len(nodes))
+		return nodes
+	case BNODE_NODE:
+		// each kid gets the KVs up to the key of the next kid
+		start := 0
+		for idx := uint16(0); idx < node.nkeys(); idx++ {
+			end := len(keys)
+			if idx+1 < node.nkeys() {
+				next := node.getKey(idx + 1)
+				for end = start; end < len(keys) && tree.compare(keys[end], next) < 0; end++ {
+				}
+			}
+			kptr := node.getPtr(idx)
+			if start == end {
+				newKeys, newVals, newPtrs = append(newKeys, node.getKey(idx)), append(newVals, node.getVal(idx)), append(newPtrs, kptr)
+				continue
+			}
+
+			kids := treeInsertBatch(tree, tree.get(kptr), keys[start:end], vals[start:end], vptrs[start:end])
+			tree.del(kptr)
+			for _, kid := range kids {
+				val := kidCountVal(node.flags(), kid)
+				newKeys, newVals, newPtrs = append(newKeys, kid.getKey(0)), append(newVals, val), append(newPtrs, tree.new(kid))
+			}
+			start = end
+		}
+		nodes := nodePack(tree, BNODE_NODE|node.flags(), newKeys, newVals, newPtrs)
+		tree.observeSplit(len(nodes))
+		return nodes
+	default:
+		panic("bad node!")
+	}
+}
+
+// pack entries into as few nodes as possible, spreading them evenly
+// so the nodes are not left full. the nodes are not allocated
+func nodePack(
+	tree *BTree, btype uint16,
+	keys [][]byte, vals [][]byte, ptrs []uint64,
+) []BNode {
+	pageSize := int(tree.pageSize())
+	sizes := make([]int, len(keys))
+	total := 0
+	for i := range keys {
+		sizes[i] = 8 + 2 + 4 + len(keys[i])
+		if vals != nil {
+			sizes[i] += len(vals[i])
+		}
+		if btype&BNODE_PREFIX != 0 {
+			sizes[i] += 2 // the shared prefix length
+		}
+		total += sizes[i]
+	}
+
+	// find the number of nodes by filling each one up to the average
+	var ends []int
+	for n := (total + pageSize - HEADER - 1) / (pageSize - HEADER); ; n++ {
+		target := (total + n - 1) / n
+		ends = ends[:0]
+		for start := 0; start < len(keys); {
+			end, size := start, 0
+			for end < len(keys) && size < target && HEADER+size+sizes[end] <= pageSize {
+				size += sizes[end]
+				end++
+			}
+			ends = append(ends, end)
+			start = end
+		}
+		if len(ends) <= n {
+			break
+		}
+	}
+
+	nodes := make([]BNode, len(ends))
+	start := 0
+	for i, end := range ends {
+		node := BNode(make([]byte, pageSize))
+		node.setHeader(btype, uint16(end-start))
+		for j := start; j < end; j++ {
+			var val []byte
+			if vals != nil {
+				val = vals[j]
+			}
+			nodeAppendKV(node, uint16(j-start), ptrs[j], keys[j], val)
+		}
+		nodes[i] = node
+		start = end
+	}
+	return nodes
+}
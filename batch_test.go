@@ -0,0 +1,98 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestInsertBatchIterateKVs(t *testing.T) {
+	tree := NewMemTree()
+	var kvs []KV
+	for i := 0; i < 2000; i++ {
+		kvs = append(kvs, KV{Key: []byte(fmt.Sprintf("key%04d", i)), Val: []byte(fmt.Sprint(i))})
+	}
+	// in a shuffled order, with a key given twice
+	batch := make([]KV, 0, len(kvs)+1)
+	for i := range kvs {
+		batch = append(batch, kvs[i*7919%len(kvs)])
+	}
+	batch = append(batch, KV{Key: kvs[0].Key, Val: []byte("old")}, kvs[0])
+	if err := tree.InsertBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	i := 0
+	for iter := tree.Iterate(); iter.Next(); i++ {
+		kv := iter.KV()
+		if !bytes.Equal(kv.Key, kvs[i].Key) || !bytes.Equal(kv.Val, kvs[i].Val) {
+			t.Fatalf("KV %d is %q=%q, want %q=%q", i, kv.Key, kv.Val, kvs[i].Key, kvs[i].Val)
+		}
+	}
+	if i != len(kvs) || tree.Len() != len(kvs) {
+		t.Fatalf("%d KVs, Len %d", i, tree.Len())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// count the pages allocated by the tree
+func countNews(tree *BTree) *int {
+	n := new(int)
+	alloc := tree.new
+	tree.new = func(node []byte) uint64 {
+		*n++
+		return alloc(node)
+	}
+	return n
+}
+
+func TestInsertBatchRebuildsOnce(t *testing.T) {
+	batched, single := testTree(5000), testTree(5000)
+	var kvs []KV
+	for i := 0; i < 200; i++ {
+		// between the keys of a few leaves
+		kvs = append(kvs, KV{Key: []byte(fmt.Sprintf("key002000-%03d", i)), Val: []byte("new")})
+	}
+
+	b, s := countNews(batched), countNews(single)
+	if err := batched.InsertBatch(kvs); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range kvs {
+		single.Insert(kv.Key, kv.Val)
+	}
+	if !bytes.Equal(batched.ContentHash(), single.ContentHash()) {
+		t.Fatal("the trees differ")
+	}
+	// the path to the leaf and the leaves it splits into
+	if height := batched.Stats().Height; *b > height+2 || *s < 200*height {
+		t.Fatalf("%d pages allocated by the batch, %d by the inserts", *b, *s)
+	}
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	kvs := make([]KV, 1000)
+	for i := range kvs {
+		kvs[i] = KV{Key: []byte(fmt.Sprintf("key%06d-%d", i*7919%5000, i)), Val: make([]byte, 100)}
+	}
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tree := testTree(5000)
+			b.StartTimer()
+			tree.InsertBatch(kvs)
+		}
+	})
+	b.Run("insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tree := testTree(5000)
+			b.StartTimer()
+			for _, kv := range kvs {
+				tree.Insert(kv.Key, kv.Val)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package btree
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// BloomFilters keeps a bloom filter of the keys of each leaf, so that a
+// lookup of a missing key can skip reading the leaf. the filters are kept
+// in memory next to the tree, keyed by the page of the leaf. pages are
+// never modified in place, so a filter is valid until its page is
+// deallocated or allocated again.
+// it's safe for the concurrent reads of a SafeTree
+type BloomFilters struct {
+	mu      sync.Mutex
+	bits    int // the size of each filter in bits
+	hashes  int // the number of bits set per key
+	filters map[uint64][]uint64
+	skipped uint64
+}
+
+// UseBloom keeps a filter of bits bits with hashes bits set per key for
+// each leaf, which is built when the leaf is written or first read.
+// the filters assume the default key order, so Cmp must not be set.
+// it must be set up before the tree is used
+func (tree *BTree) UseBloom(bits int, hashes int) *BloomFilters {
+	utils.Assert(tree.Cmp == nil, "bloom filters with a custom key order")
+	utils.Assert(bits > 0 && hashes > 0, "empty bloom filter")
+	bloom := &BloomFilters{bits: bits, hashes: hashes, filters: map[uint64][]uint64{}}
+	new, del := tree.new, tree.del
+	tree.new = func(node []byte) uint64 {
+		ptr := new(node)
+		bloom.invalidate(ptr)
+		if BNode(node).btype() == BNODE_LEAF {
+			bloom.add(ptr, node)
+		}
+		return ptr
+	}
+	tree.del = func(ptr uint64) {
+		bloom.invalidate(ptr)
+		del(ptr)
+	}
+	tree.bloom = bloom
+	return bloom
+}
+
+// the bit positions of a key, by double hashing
+func (bloom *BloomFilters) positions(key []byte, fn func(bit int)) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	for i := 0; i < bloom.hashes; i++ {
+		fn(int((h1 + uint32(i)*h2) % uint32(bloom.bits)))
+	}
+}
+
+// build the filter of a leaf
+func (bloom *BloomFilters) add(ptr uint64, node BNode) {
+	filter := make([]uint64, (bloom.bits+63)/64)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		bloom.positions(node.getKey(i), func(bit int) {
+			filter[bit/64] |= 1 << (bit % 64)
+		})
+	}
+	bloom.mu.Lock()
+	defer bloom.mu.Unlock()
+	bloom.filters[ptr] = filter
+}
+
+// whether the filter of the leaf was built
+func (bloom *BloomFilters) has(ptr uint64) bool {
+	bloom.mu.Lock()
+	defer bloom.mu.Unlock()
+	_, ok := bloom.filters[ptr]
+	return ok
+}
+
+// false if the key is certainly not in the leaf
+func (bloom *BloomFilters) mayContain(ptr uint64, key []byte) bool {
+	bloom.mu.Lock()
+	defer bloom.mu.Unlock()
+	filter, ok := bloom.filters[ptr]
+	if !ok {
+		return true // not built yet
+	}
+	found := true
+	bloom.positions(key, func(bit int) {
+		found = found && filter[bit/64]&(1<<(bit%64)) != 0
+	})
+	if !found {
+		bloom.skipped++
+	}
+	return found
+}
+
+// drop the filter of a page whose content is changing
+func (bloom *BloomFilters) invalidate(ptr uint64) {
+	bloom.mu.Lock()
+	defer bloom.mu.Unlock()
+	delete(bloom.filters, ptr)
+}
+
+// Skipped returns the number of leaf reads avoided by the filters
+func (bloom *BloomFilters) Skipped() uint64 {
+	bloom.mu.Lock()
+	defer bloom.mu.Unlock()
+	return bloom.skipped
+}
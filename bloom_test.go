@@ -0,0 +1,55 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilters(t *testing.T) {
+	tree := NewMemTree()
+	bloom := tree.UseBloom(1024, 4)
+	for i := 0; i < 5000; i += 2 {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 20))
+	}
+	// the filters follow the inserts and deletes
+	for i := 0; i < 5000; i += 4 {
+		tree.Delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	tree.Insert([]byte("key0001"), nil)
+
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		want := i%4 == 2 || i == 1
+		if _, ok := tree.Get(key); ok != want || tree.Exists(key) != want {
+			t.Fatalf("%s: found %v, want %v", key, ok, want)
+		}
+	}
+	// the 3749 missing keys are looked up twice, nearly all of the
+	// lookups skip their leaf
+	if n := bloom.Skipped(); n < 2*3749*95/100 {
+		t.Fatalf("%d leaf reads skipped", n)
+	}
+}
+
+// lookups of missing keys between the keys of the tree
+func BenchmarkBloomNegative(b *testing.B) {
+	for _, useBloom := range []bool{false, true} {
+		b.Run(fmt.Sprintf("bloom=%v", useBloom), func(b *testing.B) {
+			tree := NewMemTree()
+			if useBloom {
+				tree.UseBloom(1024, 4)
+			}
+			for i := 0; i < 20000; i++ {
+				tree.Insert([]byte(fmt.Sprintf("key%06d", i)), make([]byte, 100))
+			}
+			keys := make([][]byte, 1000)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key%06d-", i*7919%20000))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tree.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
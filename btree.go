@@ -3,35 +3,115 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"unsafe"
+	"math"
 
 	"github.com/Jeromephilip/go-database/utils"
 )
 
-const HEADER = 4
+// the node header:
+// | type | nkeys | checksum |
+// |  2B  |  2B   |    4B    |
+// the checksum is only maintained by the file store, see pageChecksum
+const HEADER = 8
 
 const BTREE_PAGE_SIZE = 4096
 const BTREE_MAX_KEY_SIZE = 1000
-const BTREE_MAX_VAL_SIZE = 3000
+const BTREE_MAX_VAL_SIZE = 3000 // larger values are moved to overflow pages
 
 type BNode []byte // dumped to disk
 
 const (
-	BNODE_NODE = 1 // internal nodes without values
+	BNODE_NODE = 1 // internal nodes without values, unless BNODE_COUNTS is set
 	BNODE_LEAF = 2 // leaf nodes with values
 )
 
+// how a node that outgrows its page is split, see BTree.SplitPolicy
+const (
+	SPLIT_HALF   = 0 // split into 2 halves of similar size
+	SPLIT_APPEND = 1 // keep the left node nearly full when the new key is the last one
+)
+
+// node flags, stored in the high byte of the type field
+const (
+	BNODE_PREFIX = 1 << 8 // leaf keys are stored as suffixes of an anchor key
+	BNODE_COUNTS = 1 << 9 // internal node values are the key counts of the kids
+)
+
+// a key-value pair
+type KV struct {
+	Key []byte
+	Val []byte
+}
+
 type BTree struct {
 	root uint64
 	get func(uint64) []byte // dereference a pointer
 	new func([]byte) uint64 // allocate a new page
 	del func(uint64) 		// deallocate a page
+	// where the callbacks come from, nil if they were set directly
+	store Store
+	// the page size in bytes, BTREE_PAGE_SIZE if zero
+	psize uint16
+	// the number of keys, not counting the dummy key, see Len
+	count int
+	// the number of committed updates, iterators check it to detect changes
+	mods uint64
+	// filters of the leaf keys for lookups, nil unless UseBloom was called
+	bloom *BloomFilters
+	// notified of the work of the tree, nil unless Observe was called
+	obs Observer
+	// pages freed while snapshots are open, see Snapshot
+	snap struct {
+		open  int          // number of open snapshots
+		del   func(uint64) // the original del callback
+		freed []uint64
+		kept  int // freed by the committed updates, see snapshotCommitted
+	}
+
+	// store leaf keys with prefix compression. only read when the first
+	// leaf is created, later leaves keep the layout of the ones they come from
+	PrefixCompression bool
+	// keep the key count of each kid in internal nodes, so Count can skip the
+	// subtrees inside the range. like PrefixCompression, it's only read when
+	// the first internal node is created, see nodeFlags
+	SubtreeCounts bool
+	// SPLIT_HALF or SPLIT_APPEND. with SPLIT_APPEND sequential inserts fill
+	// the nodes instead of leaving them half empty
+	SplitPolicy int
+	// the fill, as a fraction of the page, below which a node shrunk by a
+	// delete is merged with or borrows from a sibling, 1/2 if 0. a lower
+	// fill leaves sparser nodes but fewer merges that are split again by
+	// the next inserts, see shouldMerge
+	MergeFill float64
+	// compresses the values if set, e.g. FlateCodec. like Cmp it's not
+	// persisted, a tree must always be opened with the same codec
+	Codec Codec
+	// the order of the keys, bytes.Compare if nil. keys comparing equal are
+	// the same key. the empty key must sort first as it's the dummy key.
+	// it's not persisted, so a tree must always be opened with the same
+	// comparator or lookups break, which Verify detects as unsorted keys.
+	// ScanPrefix still matches the prefix byte by byte
+	Cmp func([]byte, []byte) int
+}
+
+// compare keys in the order of the tree
+func (tree *BTree) compare(a []byte, b []byte) int {
+	if tree.Cmp == nil {
+		return bytes.Compare(a, b)
+	}
+	return tree.Cmp(a, b)
 }
 
 // return the type of node (internal or leaf) reading the first two bytes
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) & 0xff
+}
+
+// return the layout flags of the node
+func (node BNode) flags() uint16 {
+	return binary.LittleEndian.Uint16(node[0:2]) &^ 0xff
 }
 
 // return the number of keys in the node
@@ -39,7 +119,7 @@ func (node BNode) nkeys() uint16 {
 	return binary.LittleEndian.Uint16(node[2:4])
 }
 
-// set the node type and key count in the header
+// set the node type (including its flags) and key count in the header
 func (node BNode) setHeader(btype uint16, nkeys uint16) {
 	binary.LittleEndian.PutUint16(node[0:2], btype)
 	binary.LittleEndian.PutUint16(node[2:4], nkeys)
@@ -54,11 +134,16 @@ func (node BNode) getPtr(idx uint16) uint64 {
 }
 
 // Sets the pointer with idx and value
-func (node BNode) setPtr(idx uint16, val uint64)
+func (node BNode) setPtr(idx uint16, val uint64) {
+	utils.Assert(idx < node.nkeys(), "index less than value")
+	pos := HEADER + 8*idx
+	binary.LittleEndian.PutUint64(node[pos:], val)
+}
 
 
 func offsetPos(node BNode, idx uint16) uint16 {
 	utils.Assert(1 <= idx && idx <= node.nkeys(), "not found offset position")
+	return HEADER + 8*node.nkeys() + 2*(idx-1)
 }
 
 // Manage key-value offsets within the node
@@ -69,7 +154,15 @@ func (node BNode) getOffset(idx uint16) uint16 {
 
 	return binary.LittleEndian.Uint16(node[offsetPos(node, idx):])
 }
-func (node BNode) setOffset(idx uint16, offset uint16)
+
+// the offset of the first KV is always zero, so there is nothing to store for idx 0
+func (node BNode) setOffset(idx uint16, offset uint16) {
+	if idx == 0 {
+		return
+	}
+
+	binary.LittleEndian.PutUint16(node[offsetPos(node, idx):], offset)
+}
 
 // kvPos returns the positon of the nth KV pair relative to the whole node.
 func (node BNode) kvPos(idx uint16) uint16 {
@@ -82,36 +175,88 @@ func (node BNode) getKey(idx uint16) []byte {
 	utils.Assert(idx < node.nkeys(), "index is greater than nkeys")
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
+	key := node[pos+4:][:klen:klen] // appending to it must not overwrite the page
+	if node.flags()&BNODE_PREFIX == 0 || idx <= node.anchor() {
+		return key
+	}
+
+	// | shared prefix length | suffix |
+	plen := binary.LittleEndian.Uint16(key[0:2])
+	anchor := node.getKey(node.anchor())
+	return append(anchor[:plen:plen], key[2:]...)
+}
+
+// getKey with bounds checks, for a page that may be corrupt, e.g. when
+// scanning arbitrary pages or when checksums are off. the stored
+// lengths are checked against the page instead of being trusted
+func (node BNode) checkedKey(idx uint16) ([]byte, error) {
+	if len(node) < HEADER {
+		return nil, errors.New("truncated node header")
+	}
+	nkeys := int(node.nkeys())
+	if int(idx) >= nkeys {
+		return nil, fmt.Errorf("key %d of a node with %d keys", idx, nkeys)
+	}
+	if HEADER+10*nkeys > len(node) {
+		return nil, fmt.Errorf("%d keys don't fit in the node", nkeys)
+	}
+	pos := HEADER + 10*nkeys + int(node.getOffset(idx))
+	if pos+4 > len(node) {
+		return nil, fmt.Errorf("KV %d is out of the node", idx)
+	}
+	klen := int(binary.LittleEndian.Uint16(node[pos:]))
+	if pos+4+klen > len(node) {
+		return nil, fmt.Errorf("key %d of %d bytes is out of the node", idx, klen)
+	}
+	key := node[pos+4:][:klen:klen]
+	if node.flags()&BNODE_PREFIX == 0 || idx <= node.anchor() {
+		return key, nil
+	}
 
-	return node[pos+4:][:klen]
+	anchor, err := node.checkedKey(node.anchor())
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 2 || int(binary.LittleEndian.Uint16(key[0:2])) > len(anchor) {
+		return nil, fmt.Errorf("bad shared prefix of key %d", idx)
+	}
+	return node.getKey(idx), nil
 }
 
 // Retrieves the key at a specific index by decoding it from the encoded position and length in the node
-func (node BNode) getVal(idx uint16) []byte
+func (node BNode) getVal(idx uint16) []byte {
+	utils.Assert(idx < node.nkeys(), "index is greater than nkeys")
+	pos := node.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(node[pos+0:])
+	vlen := binary.LittleEndian.Uint16(node[pos+2:])
 
+	return node[pos+4+klen:][:vlen:vlen]
+}
+
+// the size of the node, HEADER for a node without keys. such nodes only
+// exist transiently while deleting, until they are merged into a sibling
 func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
 
 // Seek operation used for both range and point queries. So they are the same.
-func nodeLookupLE(node BNode, key []byte) uint16 {
-	nkeys := node.nkeys()
-	found := uint16(0)
+// returns the last index whose key is less than or equal to the key,
+// or 0 for a node without keys
+func nodeLookupLE(tree *BTree, node BNode, key []byte) uint16 {
 	// the first key is a copy from the parent node
 	// thus it's always less than or equal to the key
-	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-
-		if cmp <= 0 {
-			found = i
-		}
-
-		if cmp >= 0 {
-			break
+	lo, hi := uint16(0), node.nkeys()
+	// binary search for the last key <= key in [lo, hi)
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if tree.compare(node.getKey(mid), key) <= 0 {
+			lo = mid
+		} else {
+			hi = mid
 		}
 	}
 
-	return found
+	return lo
 }
 
 // Insering leaves into B+Tree
@@ -121,14 +266,56 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 // inserts the new key-value pair at the correct index
 func leafInsert(
 	new BNode, old BNode, idx uint16,
-	key []byte, val []byte,
+	key []byte, val []byte, vptr uint64,
 ) {
-	new.setHeader(BNODE_LEAF, old.nkeys() + 1) // setup the header
-	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, val)
+	new.setHeader(BNODE_LEAF|old.flags(), old.nkeys() + 1) // setup the header
+	if old.flags()&BNODE_PREFIX != 0 && 0 < idx && idx <= old.anchor() {
+		// the key goes in front of the anchor, which is kept
+		nodeAppendKV(new, 0, old.getPtr(0), nil, anchorVal(old.anchor()+1))
+		nodeAppendRange(new, old, 1, 1, idx-1)
+	} else {
+		nodeAppendRange(new, old, 0, 0, idx)
+	}
+	nodeAppendKV(new, idx, vptr, key, val)
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx)
 }
 
+// replace the KV at idx, keeping the other keys as they are
+func leafUpdate(
+	new BNode, old BNode, idx uint16,
+	key []byte, val []byte, vptr uint64,
+) {
+	new.setHeader(BNODE_LEAF|old.flags(), old.nkeys())
+	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendKV(new, idx, vptr, key, val)
+	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
+}
+
+// copy the leaf and overwrite the value of the KV at idx with one of the
+// same size. the layout doesn't change, so the copy is a single memmove
+// instead of rebuilding the KVs one by one like leafUpdate
+func leafUpdateVal(new BNode, old BNode, idx uint16, val []byte) {
+	utils.Assert(len(val) == len(old.getVal(idx)), "the value changes size")
+	copy(new, old[:old.nbytes()])
+	copy(new.getVal(idx), val)
+}
+
+// Removing a key from a leaf, the counterpart of leafInsert.
+// copies the keys before and after the removed index
+// and updates the header to reflect the new key count
+func leafDelete(new BNode, old BNode, idx uint16) {
+	utils.Assert(idx < old.nkeys(), "index is greater than nkeys")
+	new.setHeader(BNODE_LEAF|old.flags(), old.nkeys()-1)
+	if old.flags()&BNODE_PREFIX != 0 && 0 < idx && idx < old.anchor() {
+		// a key in front of the anchor, the anchor moves down one
+		nodeAppendKV(new, 0, old.getPtr(0), nil, anchorVal(old.anchor()-1))
+		nodeAppendRange(new, old, 1, 1, idx-1)
+	} else {
+		nodeAppendRange(new, old, 0, 0, idx)
+	}
+	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-(idx+1))
+}
+
 // NODE COPYING FUNCTIONS
 // copy a KV into the position
 // add a specific key-value pair to a specific position within a node. It writes
@@ -138,6 +325,11 @@ func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 	// ptrs
 	new.setPtr(idx, ptr)
 
+	// a key after the anchor only stores what it doesn't share with it
+	if new.flags()&BNODE_PREFIX != 0 && idx > new.anchor() {
+		key = prefixSuffix(new.getKey(new.anchor()), key)
+	}
+
 	// KV
 	pos := new.kvPos(idx)
 	binary.LittleEndian.PutUint16(new[pos+0:], uint16(len(key)))
@@ -152,49 +344,800 @@ func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 func nodeAppendRange(
 	new BNode, old BNode,
 	dstNew uint16, srcOld uint16, n uint16,
-)
+) {
+	utils.Assert(srcOld+n <= old.nkeys(), "source range is out of bounds")
+	utils.Assert(dstNew+n <= new.nkeys(), "destination range is out of bounds")
+	if n == 0 {
+		return
+	}
+	if new.flags()&BNODE_PREFIX != 0 || old.flags()&BNODE_PREFIX != 0 {
+		// the keys are encoded against the anchor of their node,
+		// so they have to be re-encoded one by one
+		for i := uint16(0); i < n; i++ {
+			nodeAppendKV(new, dstNew+i, old.getPtr(srcOld+i), old.getKey(srcOld+i), old.getVal(srcOld+i))
+		}
+		return
+	}
+
+	// pointers
+	for i := uint16(0); i < n; i++ {
+		new.setPtr(dstNew+i, old.getPtr(srcOld+i))
+	}
+
+	// offsets, rebased onto where the range starts in the new node
+	dstBegin := new.getOffset(dstNew)
+	srcBegin := old.getOffset(srcOld)
+	for i := uint16(1); i <= n; i++ { // NOTE: the range is [1, n]
+		offset := dstBegin + old.getOffset(srcOld+i) - srcBegin
+		new.setOffset(dstNew+i, offset)
+	}
+
+	// KVs
+	begin := old.kvPos(srcOld)
+	end := old.kvPos(srcOld + n)
+	copy(new[new.kvPos(dstNew):], old[begin:end])
+}
 
 func nodeReplaceKidN(
 	tree *BTree, new BNode, old BNode, idx uint16,
 	kids ...BNode,
 ) {
 	inc := uint16(len(kids))
-	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
+	new.setHeader(BNODE_NODE|old.flags(), old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		val := kidCountVal(old.flags(), node)
+		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), val)
 		// 				  ^position      ^pointer        ^key            ^val
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
-func nodeSplit2(left BNode, right BNode, old BNode) {
+// split an oversized node into 2 nodes, the right one always fits in a page.
+// the left one is kept under a page when possible, otherwise nodeSplit3
+// splits it again. appended means the last KV of the node was just added
+func nodeSplit2(tree *BTree, left BNode, right BNode, old BNode, appended bool) {
+	utils.Assert(old.nkeys() >= 2, "a single KV can not be split")
+
+	// the initial guess
+	nleft := old.nkeys() / 2
+	if appended && tree.SplitPolicy == SPLIT_APPEND {
+		// more keys will follow on the right, leave the left node full
+		nleft = old.nkeys() - 1
+	}
+
+	// try to fit the left half
+	rangeBytes := nodeRangeBytes(old)
+	leftBytes := func() uint16 {
+		return rangeBytes(0, nleft)
+	}
+	for leftBytes() > tree.pageSize() && nleft > 1 {
+		nleft--
+	}
+
+	// try to fit the right half
+	rightBytes := func() uint16 {
+		return rangeBytes(nleft, old.nkeys())
+	}
+	for rightBytes() > tree.pageSize() && nleft < old.nkeys()-1 {
+		nleft++
+	}
 
+	nright := old.nkeys() - nleft
+	left.setHeader(old.btype()|old.flags(), nleft)
+	right.setHeader(old.btype()|old.flags(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+	// the left half may be still too big
+	utils.Assert(right.nbytes() <= tree.pageSize(), "right node is greater than the defined page size")
 }
 
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
+// split a node of up to 2 pages so that every result fits in a page.
+// this can't fail on a single KV too large for a page: checkKV bounds the
+// keys and larger values go to overflow pages, so a node of 1 KV always
+// fits (see checkPageSize), and each of the 2 splits can put each KV alone
+func nodeSplit3(tree *BTree, old BNode, appended bool) (uint16, [3]BNode) {
+	pageSize := tree.pageSize()
+	if old.nbytes() <= pageSize {
+		old = old[:pageSize]
 		return 1, [3]BNode{old}
 	}
 
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
+	left := nodeAlloc(tree, 2*int(pageSize))
+	right := nodeAlloc(tree, int(pageSize))
+	nodeSplit2(tree, left, right, old, appended)
 
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left = left[:BTREE_PAGE_SIZE]
+	if left.nbytes() <= pageSize {
+		left = left[:pageSize]
 		return 2, [3]BNode{left, right} // 2 nodes
 	}
 
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
-	utils.Assert(leftleft.nbytes() <= BTREE_PAGE_SIZE, "left node less than the defined page size")
+	leftleft := nodeAlloc(tree, int(pageSize))
+	middle := nodeAlloc(tree, int(pageSize))
+	nodeSplit2(tree, leftleft, middle, left, false)
+	utils.Assert(leftleft.nbytes() <= pageSize, "left node is greater than the defined page size")
+	nodeFree(left)
 	return 3, [3]BNode{leftleft, middle, right} // 3 nodes
 }
 
-func init() {
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	utils.Assert(node1max <= BTREE_PAGE_SIZE, "Node is greater than defined page size")
+// insert a KV into a node, the result might be split into 2 nodes.
+// the caller is responsible for deallocating the input node
+// and splitting and allocating result nodes.
+// the modes of an insertion
+const (
+	MODE_UPSERT      = 0 // add the KV or replace the value of the key
+	MODE_UPDATE_ONLY = 1 // replace the value of an existing key
+	MODE_INSERT_ONLY = 2 // add the KV unless the key exists
+)
+
+// an insertion passed down the tree
+type insertReq struct {
+	key  []byte
+	val  []byte
+	vptr uint64 // the first overflow page of the value, 0 if it's stored in the leaf
+	mode int
+	// the KV was added after the last key of the current node, see SPLIT_APPEND
+	appended bool
+}
+
+// returns an empty node if the mode leaves nothing to do
+func treeInsert(tree *BTree, node BNode, req *insertReq) BNode {
+	// the result node is allowed to be bigger than 1 page and will be split if so
+	new := nodeAlloc(tree, 2*int(tree.pageSize()))
+
+	// where to insert the key?
+	idx := nodeLookupLE(tree, node, req.key)
+	switch node.btype() {
+	case BNODE_LEAF:
+		found := tree.compare(req.key, node.getKey(idx)) == 0
+		switch {
+		case found && req.mode == MODE_INSERT_ONLY:
+			nodeFree(new)
+			return BNode{} // keep the existing value
+		case !found && req.mode == MODE_UPDATE_ONLY:
+			nodeFree(new)
+			return BNode{} // not found
+		case found:
+			// replace the value instead of adding a second copy of the key
+			vptr := node.getPtr(idx)
+			if vptr == 0 && req.vptr == 0 && len(req.val) == len(node.getVal(idx)) &&
+				bytes.Equal(req.key, node.getKey(idx)) {
+				// the layout stays the same
+				leafUpdateVal(new, node, idx, req.val)
+			} else {
+				if vptr != 0 {
+					tree.overflowFree(vptr)
+				}
+				leafUpdate(new, node, idx, req.key, req.val, req.vptr)
+			}
+			if tree.obs != nil {
+				tree.obs.OnInsert()
+			}
+		default:
+			leafInsert(new, node, idx+1, req.key, req.val, req.vptr)
+			req.appended = idx+1 == node.nkeys()
+			tree.count++
+			if tree.obs != nil {
+				tree.obs.OnInsert()
+			}
+		}
+	case BNODE_NODE:
+		if !nodeInsert(tree, new, node, idx, req) {
+			nodeFree(new)
+			return BNode{}
+		}
+	default:
+		panic("bad node!")
+	}
+
+	return new
+}
+
+// part of the treeInsert(): KV insertion to an internal node
+func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, req *insertReq) bool {
+	// get and deallocate the kid node
+	kptr := node.getPtr(idx)
+	knode := treeInsert(tree, tree.get(kptr), req)
+	if len(knode) == 0 {
+		return false
+	}
+	tree.del(kptr)
+	// split the result
+	nsplit, split := nodeSplit3(tree, knode, req.appended)
+	tree.observeSplit(int(nsplit))
+	// update the kid links
+	nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	nodeSplitFree(knode, nsplit, split)
+	req.appended = req.appended && idx+1 == node.nkeys()
+	return true
+}
+
+// Insert adds a KV to the tree, or replaces the value if the key exists.
+// nodes are split on the way back up to the root
+func (tree *BTree) Insert(key []byte, val []byte) (err error) {
+	defer tree.recoverUpdate(&err)
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+
+	tree.insert(key, val, MODE_UPSERT)
+	return tree.commit()
+}
+
+// Update replaces the value of an existing key,
+// returning false without modifying the tree if the key isn't there.
+// an error is returned if the KV is rejected or the update can't be committed
+func (tree *BTree) Update(key []byte, val []byte) (_ bool, err error) {
+	defer tree.recoverUpdate(&err)
+	if err := checkKV(key, val); err != nil {
+		return false, err
+	}
+	if !tree.insert(key, val, MODE_UPDATE_ONLY) {
+		return false, nil
+	}
+
+	if err := tree.commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InsertIfAbsent adds a KV unless the key already exists,
+// returning false and keeping the existing value if it does.
+// an error is returned if the KV is rejected or the update can't be committed
+func (tree *BTree) InsertIfAbsent(key []byte, val []byte) (_ bool, err error) {
+	defer tree.recoverUpdate(&err)
+	if err := checkKV(key, val); err != nil {
+		return false, err
+	}
+	if !tree.insert(key, val, MODE_INSERT_ONLY) {
+		return false, nil
+	}
+
+	if err := tree.commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InsertBatch adds multiple KVs to the tree and commits them at once.
+// nodes are rebuilt once per batch rather than once per KV, see insertBatch.
+// nothing is inserted if any of the KVs is rejected
+func (tree *BTree) InsertBatch(kvs []KV) (err error) {
+	defer tree.recoverUpdate(&err)
+	for _, kv := range kvs {
+		if err := checkKV(kv.Key, kv.Val); err != nil {
+			return err
+		}
+	}
+
+	tree.insertBatch(kvs)
+	return tree.commit()
+}
+
+// check that a KV can be stored in the tree. keys of 1 to
+// BTREE_MAX_KEY_SIZE bytes are accepted, the limit included, the empty key
+// is reserved for the dummy key. values of up to BTREE_MAX_VAL_SIZE bytes
+// are stored in the leaf and larger ones in overflow pages, so a KV at
+// both limits still fits a page (see checkPageSize)
+func checkKV(key []byte, val []byte) error {
+	if len(key) == 0 {
+		return errors.New("empty key, it's reserved for the dummy key")
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("key of %d bytes is too large, the limit is %d bytes", len(key), BTREE_MAX_KEY_SIZE)
+	}
+	return nil
+}
+
+// the Insert() without the size checks and the commit,
+// returning whether the tree was updated.
+// there is no fast path for keys past the last one: caching the rightmost
+// leaf would not save its copy, nor the copies of its ancestors, which must
+// point at the new page. the descent itself, the lookups and the page reads,
+// is ~4% of a sequential insert on a MemStore, the rest is copying pages.
+// monotonic keys are better served by SPLIT_APPEND, or by InsertBatch which
+// copies each leaf once per batch instead of once per key, ~30x faster for
+// batches of 1000 keys. see BenchmarkInsertSequential
+func (tree *BTree) insert(key []byte, val []byte, mode int) bool {
+	if tree.root == 0 && mode == MODE_UPDATE_ONLY {
+		return false
+	}
+
+	req := &insertReq{key: key, val: tree.valEncode(val), mode: mode}
+	if len(req.val) > BTREE_MAX_VAL_SIZE {
+		req.vptr, req.val = tree.overflowWrite(req.val)
+	}
+
+	if tree.root == 0 {
+		// create the first node
+		root := BNode(make([]byte, tree.pageSize()))
+		root.setHeader(BNODE_LEAF|tree.leafFlags(), 2)
+		// a dummy key, this makes the tree cover the whole key space.
+		// thus a lookup can always find a containing node.
+		nodeAppendKV(root, 0, 0, nil, nil)
+		nodeAppendKV(root, 1, req.vptr, key, req.val)
+		tree.root = tree.new(root)
+		tree.count = 1
+		if tree.obs != nil {
+			tree.obs.OnInsert()
+		}
+		return true
+	}
+
+	node := treeInsert(tree, tree.get(tree.root), req)
+	if len(node) == 0 {
+		if req.vptr != 0 {
+			tree.overflowFree(req.vptr)
+		}
+		return false
+	}
+	nsplit, split := nodeSplit3(tree, node, req.appended)
+	tree.observeSplit(int(nsplit))
+	tree.del(tree.root)
+	tree.setRoot(nsplit, split)
+	nodeSplitFree(node, nsplit, split)
+	return true
+}
+
+// allocate the split result of the old root as the new root,
+// adding a new level if the old root was split. the new root is an
+// internal node with a link to each half, its first key is the dummy key
+// of the first half so it still covers the whole key space
+func (tree *BTree) setRoot(nsplit uint16, split [3]BNode) {
+	if nsplit == 1 {
+		tree.root = tree.new(split[0])
+		return
+	}
+
+	utils.Assert(len(split[0].getKey(0)) == 0, "the first half of the root doesn't start with the dummy key")
+	flags := tree.nodeFlags(split[0])
+	root := BNode(make([]byte, tree.pageSize()))
+	root.setHeader(BNODE_NODE|flags, nsplit)
+	for i, knode := range split[:nsplit] {
+		ptr, key := tree.new(knode), knode.getKey(0)
+		nodeAppendKV(root, uint16(i), ptr, key, kidCountVal(flags, knode))
+	}
+	tree.root = tree.new(root)
+}
+
+// Get looks up a key, returning its value and whether it was found.
+// a key in a page failing its checksum is not found, the error is then
+// returned by Close, as for the other reads without an error to return
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+	defer tree.recoverChecksum()
+	node, idx, ok := tree.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	return tree.leafVal(node, idx), true
+}
+
+// GetInto looks up a key like Get but copies its value into dst, so the
+// caller never holds a slice into the pages. it returns the length of the
+// value, which is the size needed when dst is too small to copy it into
+func (tree *BTree) GetInto(key []byte, dst []byte) (int, bool) {
+	defer tree.recoverChecksum()
+	node, idx, ok := tree.lookup(key)
+	if !ok {
+		return 0, false
+	}
+	return tree.leafValInto(node, idx, dst), true
+}
+
+// Exists reports whether the key is in the tree like Get,
+// but without reading the value, which may span overflow pages.
+// as for Get, a key in a page failing its checksum is not found
+func (tree *BTree) Exists(key []byte) bool {
+	defer tree.recoverChecksum()
+	_, _, ok := tree.lookup(key)
+	return ok
+}
+
+// find the leaf and the index of a key
+func (tree *BTree) lookup(key []byte) (BNode, uint16, bool) {
+	if tree.root == 0 || len(key) == 0 {
+		return nil, 0, false // the dummy key is not a KV
+	}
+
+	ptr := tree.root
+	node := BNode(tree.get(ptr))
+	for node.btype() == BNODE_NODE {
+		ptr = node.getPtr(nodeLookupLE(tree, node, key))
+		if tree.bloom != nil && !tree.bloom.mayContain(ptr, key) {
+			return nil, 0, false // the leaf doesn't have it
+		}
+		node = tree.get(ptr)
+	}
+	if tree.bloom != nil && !tree.bloom.has(ptr) {
+		tree.bloom.add(ptr, node)
+	}
+
+	idx := nodeLookupLE(tree, node, key)
+	if tree.compare(key, node.getKey(idx)) != 0 {
+		return nil, 0, false
+	}
+	return node, idx, true
+}
+
+// Len returns the number of keys in the tree without walking it
+func (tree *BTree) Len() int {
+	return tree.count
+}
+
+// Min returns the first KV of the tree, false if the tree is empty
+func (tree *BTree) Min() ([]byte, []byte, bool) {
+	defer tree.recoverChecksum()
+	if tree.root == 0 {
+		return nil, nil, false
+	}
+
+	node := BNode(tree.get(tree.root))
+	for node.btype() == BNODE_NODE {
+		node = tree.get(node.getPtr(0))
+	}
+	if node.nkeys() < 2 {
+		// the leftmost leaf can be left with only the dummy key,
+		// then the first KV is in the next leaf
+		iter := tree.Iterate()
+		if !iter.Next() {
+			return nil, nil, false
+		}
+		return iter.Key(), iter.Val(), true
+	}
+	// skip the dummy key
+	return node.getKey(1), tree.leafVal(node, 1), true
+}
+
+// Max returns the last KV of the tree, false if the tree is empty
+func (tree *BTree) Max() ([]byte, []byte, bool) {
+	defer tree.recoverChecksum()
+	if tree.root == 0 {
+		return nil, nil, false
+	}
+
+	node := BNode(tree.get(tree.root))
+	for node.btype() == BNODE_NODE {
+		node = tree.get(node.getPtr(node.nkeys() - 1))
+	}
+	last := node.nkeys() - 1
+	if last == 0 && len(node.getKey(0)) == 0 {
+		return nil, nil, false // only the dummy key
+	}
+	return node.getKey(last), tree.leafVal(node, last), true
+}
+
+// WouldSplit reports whether inserting the KV would split its leaf,
+// without modifying the tree. the KV is assumed to pass checkKV
+func (tree *BTree) WouldSplit(key []byte, val []byte) bool {
+	defer tree.recoverChecksum()
+	if tree.root == 0 {
+		return false
+	}
+
+	node := BNode(tree.get(tree.root))
+	for node.btype() == BNODE_NODE {
+		node = tree.get(node.getPtr(nodeLookupLE(tree, node, key)))
+	}
+	val = tree.valEncode(val)
+	if len(val) > BTREE_MAX_VAL_SIZE {
+		val = make([]byte, 8) // the leaf only stores the length
+	}
+
+	// build the updated leaf to get its exact size
+	new := BNode(make([]byte, 2*tree.pageSize()))
+	idx := nodeLookupLE(tree, node, key)
+	if tree.compare(key, node.getKey(idx)) == 0 {
+		leafUpdate(new, node, idx, key, val, 0)
+	} else {
+		leafInsert(new, node, idx+1, key, val, 0)
+	}
+	return new.nbytes() > tree.pageSize()
+}
+
+// delete a key from the tree
+func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+	// where to find the key?
+	idx := nodeLookupLE(tree, node, key)
+	switch node.btype() {
+	case BNODE_LEAF:
+		if tree.compare(key, node.getKey(idx)) != 0 {
+			return BNode{} // not found
+		}
+		// delete the key in the leaf, along with the pages of a large value
+		if vptr := node.getPtr(idx); vptr != 0 {
+			tree.overflowFree(vptr)
+		}
+		new := BNode(make([]byte, tree.pageSize()))
+		leafDelete(new, node, idx)
+		tree.count--
+		if tree.obs != nil {
+			tree.obs.OnDelete()
+		}
+		return new
+	case BNODE_NODE:
+		return nodeDelete(tree, node, idx, key)
+	default:
+		panic("bad node!")
+	}
+}
+
+// part of the treeDelete(): delete a key from the kid of an internal node
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+	// recurse into the kid
+	kptr := node.getPtr(idx)
+	updated := treeDelete(tree, tree.get(kptr), key)
+	if len(updated) == 0 {
+		return BNode{} // not found
+	}
+	tree.del(kptr)
+
+	// the first key of a kid may have grown, so the result
+	// is allowed to be bigger than 1 page and will be split if so
+	new := BNode(make([]byte, 2*tree.pageSize()))
+
+	// check for merging or borrowing
+	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	switch {
+	case mergeDir < 0: // left
+		nkids, kids := nodeRebalance(tree, sibling, updated)
+		tree.del(node.getPtr(idx - 1))
+		nodeReplace2Kid(tree, new, node, idx-1, kids[:nkids]...)
+	case mergeDir > 0: // right
+		nkids, kids := nodeRebalance(tree, updated, sibling)
+		tree.del(node.getPtr(idx + 1))
+		nodeReplace2Kid(tree, new, node, idx, kids[:nkids]...)
+	case updated.nkeys() == 0:
+		// the only kid is empty, the parent becomes empty too
+		utils.Assert(node.nkeys() == 1 && idx == 0, "empty kid has a sibling")
+		new.setHeader(BNODE_NODE|node.flags(), 0)
+	default:
+		nsplit, split := nodeSplit3(tree, updated, false)
+		tree.observeSplit(int(nsplit))
+		nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	}
+
+	return new
+}
+
+// should the updated kid be merged with or borrow from a sibling?
+// returns -1 for the left sibling, +1 for the right one and 0 for neither
+func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
+	// an empty kid is merged whatever the MergeFill
+	if updated.nbytes() >= tree.mergeBytes() && updated.nkeys() > 0 {
+		return 0, BNode{}
+	}
+
+	var left, right BNode
+	if idx > 0 {
+		left = tree.get(node.getPtr(idx - 1))
+		if left.maxBytes()+updated.maxBytes()-HEADER <= int(tree.pageSize()) {
+			return -1, left
+		}
+	}
+	if idx+1 < node.nkeys() {
+		right = tree.get(node.getPtr(idx + 1))
+		if right.maxBytes()+updated.maxBytes()-HEADER <= int(tree.pageSize()) {
+			return +1, right
+		}
+	}
+
+	// neither sibling can absorb the kid, borrow keys from one of them instead.
+	// the 2 are combined in a buffer of 2 pages to be split again, which
+	// compressed keys re-encoded against another anchor may not fit in
+	canBorrow := func(sibling BNode) bool {
+		return updated.nkeys() == 0 ||
+			sibling.maxBytes()+updated.maxBytes()-HEADER <= 2*int(tree.pageSize())
+	}
+	if len(left) > 0 && canBorrow(left) {
+		return -1, left
+	}
+	if len(right) > 0 && canBorrow(right) {
+		return +1, right
+	}
+	return 0, BNode{}
+}
+
+// the size below which a kid is merged, see MergeFill
+func (tree *BTree) mergeBytes() uint16 {
+	if tree.MergeFill <= 0 {
+		return tree.pageSize() / 2
+	}
+	return uint16(min(tree.MergeFill, 1) * float64(tree.pageSize()))
+}
+
+// merge 2 sibling nodes into 1
+func nodeMerge(tree *BTree, new BNode, left BNode, right BNode) {
+	utils.Assert(left.btype() == right.btype(), "merging nodes of different types")
+	utils.Assert(left.maxBytes()+right.maxBytes()-HEADER <= int(tree.pageSize()), "merged node is greater than the defined page size")
+	new.setHeader(left.btype()|left.flags(), left.nkeys()+right.nkeys())
+	nodeAppendRange(new, left, 0, 0, left.nkeys())
+	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
+}
+
+// merge 2 siblings if they fit in a page, otherwise split them
+// again so keys are moved from the bigger one to the smaller one
+func nodeRebalance(tree *BTree, left BNode, right BNode) (uint16, [3]BNode) {
+	if left.maxBytes()+right.maxBytes()-HEADER <= int(tree.pageSize()) {
+		merged := BNode(make([]byte, tree.pageSize()))
+		nodeMerge(tree, merged, left, right)
+		if tree.obs != nil {
+			tree.obs.OnMerge()
+		}
+		return 1, [3]BNode{merged}
+	}
+
+	combined := BNode(make([]byte, 2*tree.pageSize()))
+	combined.setHeader(left.btype()|left.flags(), left.nkeys()+right.nkeys())
+	nodeAppendRange(combined, left, 0, 0, left.nkeys())
+	nodeAppendRange(combined, right, left.nkeys(), 0, right.nkeys())
+	return nodeSplit3(tree, combined, false)
+}
+
+// replace 2 adjacent links with the given kids
+func nodeReplace2Kid(
+	tree *BTree, new BNode, old BNode, idx uint16,
+	kids ...BNode,
+) {
+	inc := uint16(len(kids))
+	new.setHeader(BNODE_NODE|old.flags(), old.nkeys()+inc-2)
+	nodeAppendRange(new, old, 0, 0, idx)
+	for i, node := range kids {
+		val := kidCountVal(old.flags(), node)
+		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), val)
+	}
+	nodeAppendRange(new, old, idx+inc, idx+2, old.nkeys()-(idx+2))
+}
+
+// Delete removes a key from the tree, returning false if it was not found.
+// an error is returned if the update can't be committed, the tree is then
+// left as it was
+func (tree *BTree) Delete(key []byte) (_ bool, err error) {
+	defer tree.recoverUpdate(&err)
+	if !tree.delete(key) {
+		return false, nil
+	}
+
+	if err := tree.commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteRange removes the keys in [start, end] and commits once,
+// returning the number of keys removed, 0 with the error if the scan of
+// the range or the commit fails, like Delete.
+// TODO: drop the subtrees entirely inside the range without visiting every key
+func (tree *BTree) DeleteRange(start []byte, end []byte) (_ int, err error) {
+	defer tree.recoverUpdate(&err)
+	var keys [][]byte
+	iter := tree.Range(start, end, RANGE_INCLUSIVE)
+	for iter.Next() {
+		keys = append(keys, bytes.Clone(iter.Key()))
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, key := range keys {
+		if tree.delete(key) {
+			n++
+		}
+	}
+	if n > 0 {
+		if err := tree.commit(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// FilterDelete removes every KV pred returns true for and commits once,
+// returning the number of keys removed, 0 with the error if the scan of
+// the tree or the commit fails, like Delete. the matching keys are collected
+// in a first pass, so pred sees the tree as it was before any deletion
+func (tree *BTree) FilterDelete(pred func(key []byte, val []byte) bool) (_ int, err error) {
+	defer tree.recoverUpdate(&err)
+	var keys [][]byte
+	iter := tree.Iterate()
+	for iter.Next() {
+		if pred(iter.Key(), iter.Val()) {
+			keys = append(keys, bytes.Clone(iter.Key()))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		tree.delete(key)
+	}
+	if len(keys) > 0 {
+		if err := tree.commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Clear removes every key, deallocating all the pages of the tree
+func (tree *BTree) Clear() (err error) {
+	defer tree.recoverUpdate(&err)
+	if tree.root == 0 {
+		return nil
+	}
+
+	tree.freeTree(tree.root)
+	tree.root, tree.count = 0, 0
+	return tree.commit()
+}
+
+// the Delete() without the commit
+func (tree *BTree) delete(key []byte) bool {
+	if tree.root == 0 || len(key) == 0 {
+		return false // the dummy key can't be deleted
+	}
+
+	updated := treeDelete(tree, tree.get(tree.root), key)
+	if len(updated) == 0 {
+		return false // not found
+	}
+
+	tree.del(tree.root)
+	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+		// remove a level
+		tree.root = updated.getPtr(0)
+		tree.shrinkRoot()
+		return true
+	}
+
+	nsplit, split := nodeSplit3(tree, updated, false)
+	tree.observeSplit(int(nsplit))
+	tree.setRoot(nsplit, split)
+	return true
+}
+
+// remove the levels above the root while it's an internal node with a
+// single kid, so the height of the tree goes down as keys are deleted
+func (tree *BTree) shrinkRoot() {
+	for tree.root != 0 {
+		node := BNode(tree.get(tree.root))
+		if node.btype() != BNODE_NODE || node.nkeys() != 1 {
+			return
+		}
+		tree.del(tree.root)
+		tree.root = node.getPtr(0)
+	}
+}
+
+// a page must be able to hold a node with a single KV of the maximum sizes,
+// and offsets within the page must fit in 16 bits
+func validateSizes(pageSize int, maxKey int, maxVal int) error {
+	// a KV at the size limits, with the prefix length of a compressed leaf
+	node1max := HEADER + 8 + 2 + 4 + 2 + maxKey + maxVal
+	if pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("page size %d is not a power of 2", pageSize)
+	}
+	if pageSize < node1max {
+		return fmt.Errorf("page size %d can't hold a node of %d bytes", pageSize, node1max)
+	}
+	if 2*pageSize > math.MaxUint16 {
+		return fmt.Errorf("page size %d is too large", pageSize)
+	}
+	return nil
+}
+
+// check a page size against the KV size limits of this build, done by the
+// constructors taking a page size. see debug.go for the default one
+func checkPageSize(pageSize int) error {
+	return validateSizes(pageSize, BTREE_MAX_KEY_SIZE, BTREE_MAX_VAL_SIZE)
+}
+
+// the page size of the tree
+func (tree *BTree) pageSize() uint16 {
+	if tree.psize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.psize
 }
\ No newline at end of file
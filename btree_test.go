@@ -0,0 +1,1325 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a node of the given type with the KVs, their pointers are 100, 101, ...
+// it has room for 2 pages so it can be built overfull
+func testNode(btype uint16, kvs []KV) BNode {
+	node := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	node.setHeader(btype, uint16(len(kvs)))
+	for i, kv := range kvs {
+		nodeAppendKV(node, uint16(i), uint64(100+i), kv.Key, kv.Val)
+	}
+	return node
+}
+
+// KVs key00, key01, ... with values of vlen bytes
+func testKVs(n int, vlen int) []KV {
+	kvs := make([]KV, n)
+	for i := range kvs {
+		kvs[i] = KV{
+			Key: []byte{'k', 'e', 'y', '0' + byte(i/10), '0' + byte(i%10)},
+			Val: bytes.Repeat([]byte{byte(i)}, vlen),
+		}
+	}
+	return kvs
+}
+
+// check the keys, values and pointers of a node against kvs
+func checkNode(t *testing.T, node BNode, kvs []KV, ptrs []uint64) {
+	t.Helper()
+	if int(node.nkeys()) != len(kvs) {
+		t.Fatalf("%d keys, want %d", node.nkeys(), len(kvs))
+	}
+	for i, kv := range kvs {
+		idx := uint16(i)
+		if !bytes.Equal(node.getKey(idx), kv.Key) || !bytes.Equal(node.getVal(idx), kv.Val) {
+			t.Fatalf("KV %d is %q=%q, want %q=%q", i, node.getKey(idx), node.getVal(idx), kv.Key, kv.Val)
+		}
+		if ptrs != nil && node.getPtr(idx) != ptrs[i] {
+			t.Fatalf("pointer %d is %d, want %d", i, node.getPtr(idx), ptrs[i])
+		}
+	}
+}
+
+// keys in increasing order, like a log or a time series
+func sequentialKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = EncodeUint64(uint64(i))
+	}
+	return keys
+}
+
+// the cost of appending keys one at a time. lookup only does the descent
+// of each insert on the full tree, which is what a rightmost-leaf cache
+// could save, see BTree.insert
+func BenchmarkInsertSequential(b *testing.B) {
+	const N = 100000
+	keys := sequentialKeys(N)
+	val := make([]byte, 16)
+	insert := func(tree *BTree) {
+		for _, key := range keys {
+			tree.insert(key, val, MODE_UPSERT)
+		}
+	}
+
+	b.Run("generic", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			insert(NewMemTree())
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*N), "ns/key")
+	})
+	b.Run("split-append", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := NewMemTree()
+			tree.SplitPolicy = SPLIT_APPEND
+			insert(tree)
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*N), "ns/key")
+	})
+	b.Run("batch", func(b *testing.B) {
+		kvs := make([]KV, 0, 1000)
+		for i := 0; i < b.N; i++ {
+			tree := NewMemTree()
+			for start := 0; start < N; start += cap(kvs) {
+				kvs = kvs[:0]
+				for _, key := range keys[start : start+cap(kvs)] {
+					kvs = append(kvs, KV{Key: key, Val: val})
+				}
+				tree.insertBatch(kvs)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*N), "ns/key")
+	})
+	b.Run("lookup", func(b *testing.B) {
+		tree := NewMemTree()
+		insert(tree)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				tree.lookup(key)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*N), "ns/key")
+	})
+}
+
+func TestPtrRoundTrip(t *testing.T) {
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	node.setHeader(BNODE_NODE, 3)
+	ptrs := []uint64{1, 1<<64 - 1, 0x0102030405060708}
+	for i, ptr := range ptrs {
+		node.setPtr(uint16(i), ptr)
+	}
+	for i, ptr := range ptrs {
+		if got := node.getPtr(uint16(i)); got != ptr {
+			t.Fatalf("pointer %d is %#x, want %#x", i, got, ptr)
+		}
+	}
+	// the header is left alone
+	if node.btype() != BNODE_NODE || node.nkeys() != 3 {
+		t.Fatalf("header %d %d", node.btype(), node.nkeys())
+	}
+}
+
+func TestOffsetRoundTrip(t *testing.T) {
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	node.setHeader(BNODE_LEAF, 4)
+	offsets := []uint16{0, 10, 25, 300, 4000}
+	for i, offset := range offsets {
+		node.setOffset(uint16(i), offset)
+	}
+	for i, offset := range offsets {
+		if got := node.getOffset(uint16(i)); got != offset {
+			t.Fatalf("offset %d is %d, want %d", i, got, offset)
+		}
+	}
+	// the offsets follow the pointers, the one of the first KV is not stored
+	if got := offsetPos(node, 1); got != HEADER+8*4 {
+		t.Fatalf("offsetPos(1) is %d", got)
+	}
+	if got := offsetPos(node, 4); got != HEADER+8*4+2*3 {
+		t.Fatalf("offsetPos(4) is %d", got)
+	}
+}
+
+func TestKVPosWalksKVsInOrder(t *testing.T) {
+	kvs := testKVs(5, 3)
+	kvs[2].Val = nil
+	kvs[3].Val = []byte("a longer value")
+	node := testNode(BNODE_LEAF, kvs)
+
+	// the KVs start after the pointers and the offsets
+	pos := uint16(HEADER + 8*5 + 2*5)
+	for i, kv := range kvs {
+		if got := node.kvPos(uint16(i)); got != pos {
+			t.Fatalf("KV %d at %d, want %d", i, got, pos)
+		}
+		pos += 4 + uint16(len(kv.Key)+len(kv.Val))
+	}
+	if node.nbytes() != pos {
+		t.Fatalf("nbytes %d, want %d", node.nbytes(), pos)
+	}
+	checkNode(t, node, kvs, nil)
+}
+
+func TestGetValAfterLeafInsert(t *testing.T) {
+	old := testNode(BNODE_LEAF, testKVs(3, 2))
+	val := []byte{0, 1, 2, 0xff, 'x'}
+	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	leafInsert(new, old, 1, []byte("key00a"), val, 0)
+
+	if got := new.getVal(1); !bytes.Equal(got, val) {
+		t.Fatalf("getVal is %q, want %q", got, val)
+	}
+	// the neighbours are left intact
+	kvs := testKVs(3, 2)
+	want := []KV{kvs[0], {Key: []byte("key00a"), Val: val}, kvs[1], kvs[2]}
+	checkNode(t, new, want, nil)
+}
+
+func TestGetKeyValCapped(t *testing.T) {
+	node := testNode(BNODE_LEAF, testKVs(3, 2))
+	// appending to a key or a value read from the node copies it,
+	// rather than writing over the next KV of the page
+	_ = append(node.getKey(1), "garbage"...)
+	_ = append(node.getVal(1), "garbage"...)
+	key, err := node.checkedKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = append(key, "garbage"...)
+	checkNode(t, node, testKVs(3, 2), nil)
+}
+
+func TestNodeAppendRange(t *testing.T) {
+	kvs := testKVs(10, 4)
+	old := testNode(BNODE_NODE, kvs)
+
+	// copy KVs 3..7 of old after 2 KVs of another node
+	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	new.setHeader(BNODE_NODE, 2+5)
+	nodeAppendKV(new, 0, 1, []byte("a"), []byte("x"))
+	nodeAppendKV(new, 1, 2, []byte("b"), nil)
+	nodeAppendRange(new, old, 2, 3, 5)
+
+	want := append([]KV{{Key: []byte("a"), Val: []byte("x")}, {Key: []byte("b")}}, kvs[3:8]...)
+	checkNode(t, new, want, []uint64{1, 2, 103, 104, 105, 106, 107})
+	if new.nbytes() != new.kvPos(7) {
+		t.Fatalf("nbytes %d", new.nbytes())
+	}
+
+	// an empty range copies nothing
+	empty := BNode(make([]byte, BTREE_PAGE_SIZE))
+	empty.setHeader(BNODE_NODE, 0)
+	nodeAppendRange(empty, old, 0, 10, 0)
+	if empty.nbytes() != HEADER {
+		t.Fatalf("nbytes %d", empty.nbytes())
+	}
+}
+
+func TestNodeSplit2(t *testing.T) {
+	tree := NewMemTree()
+	// about 1.5 pages of KVs
+	kvs := testKVs(60, 100)
+	old := testNode(BNODE_LEAF, kvs)
+	if old.nbytes() <= BTREE_PAGE_SIZE {
+		t.Fatalf("the node fits in a page: %d", old.nbytes())
+	}
+
+	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	right := BNode(make([]byte, BTREE_PAGE_SIZE))
+	nodeSplit2(tree, left, right, old, false)
+
+	nleft := int(left.nkeys())
+	if nleft == 0 || nleft == len(kvs) {
+		t.Fatalf("%d keys on the left", nleft)
+	}
+	for _, node := range []BNode{left, right} {
+		if node.btype() != BNODE_LEAF || node.nbytes() > BTREE_PAGE_SIZE {
+			t.Fatalf("type %d, %d bytes", node.btype(), node.nbytes())
+		}
+		if err := verifyNode(tree, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkNode(t, left, kvs[:nleft], nil)
+	checkNode(t, right, kvs[nleft:], nil)
+	// split in halves of similar size
+	if diff := int(left.nbytes()) - int(right.nbytes()); diff > 200 || diff < -200 {
+		t.Fatalf("halves of %d and %d bytes", left.nbytes(), right.nbytes())
+	}
+}
+
+func TestInsertSplitsAndReadsBack(t *testing.T) {
+	tree := NewMemTree()
+	const N = 5000
+	val := func(i int) []byte {
+		return append(EncodeUint64(uint64(i)), make([]byte, 100)...)
+	}
+	for i := 0; i < N; i++ {
+		if err := tree.Insert(EncodeUint64(uint64(i*7919%N)), val(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := tree.Stats().Height; h < 3 {
+		t.Fatalf("height %d, the inserts did not split the internal nodes", h)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < N; i++ {
+		if got, ok := tree.Get(EncodeUint64(uint64(i * 7919 % N))); !ok || !bytes.Equal(got, val(i)) {
+			t.Fatalf("key %d: %x %v", i*7919%N, got, ok)
+		}
+	}
+	if tree.Len() != N {
+		t.Fatalf("%d keys", tree.Len())
+	}
+}
+
+func TestGet(t *testing.T) {
+	tree := NewMemTree()
+	if _, ok := tree.Get([]byte("a")); ok {
+		t.Fatal("found a key in an empty tree")
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", 2*i)), []byte(fmt.Sprint(i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		val, ok := tree.Get([]byte(fmt.Sprintf("key%04d", 2*i)))
+		if !ok || string(val) != fmt.Sprint(i) {
+			t.Fatalf("key%04d: %q %v", 2*i, val, ok)
+		}
+	}
+	for _, key := range []string{
+		"a", "key", // before all the keys
+		"key0001", "key0999", "key1001", "key00001", // between 2 keys
+		"z", "key2000", // after all the keys
+	} {
+		if val, ok := tree.Get([]byte(key)); ok {
+			t.Fatalf("found %s: %q", key, val)
+		}
+	}
+	// the dummy key is not a KV
+	if _, ok := tree.Get(nil); ok {
+		t.Fatal("found the empty key")
+	}
+}
+
+// a 2-level tree with the given leaves, each made of n KVs of 100-byte
+// values. the keys are "key000", "key001", ... across the leaves and the
+// first leaf starts with the dummy key
+func testLeafTree(sizes ...int) *BTree {
+	tree := NewMemTree()
+	root := BNode(make([]byte, BTREE_PAGE_SIZE))
+	root.setHeader(BNODE_NODE, uint16(len(sizes)))
+	next := 0
+	for i, n := range sizes {
+		leaf := BNode(make([]byte, BTREE_PAGE_SIZE))
+		leaf.setHeader(BNODE_LEAF, uint16(n))
+		for j := 0; j < n; j++ {
+			key := []byte(fmt.Sprintf("key%03d", next))
+			if i == 0 && j == 0 {
+				key = nil
+			} else {
+				next++
+			}
+			nodeAppendKV(leaf, uint16(j), 0, key, make([]byte, 100))
+		}
+		nodeAppendKV(root, uint16(i), tree.new(leaf), leaf.getKey(0), nil)
+		tree.count += n
+	}
+	tree.count--
+	tree.root = tree.new(root)
+	return tree
+}
+
+// the number of KVs of each leaf under the root
+func leafSizes(tree *BTree) []int {
+	root := BNode(tree.get(tree.root))
+	var sizes []int
+	for i := uint16(0); i < root.nkeys(); i++ {
+		sizes = append(sizes, int(BNode(tree.get(root.getPtr(i))).nkeys()))
+	}
+	return sizes
+}
+
+func TestDeleteRebalance(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		leaves []int
+		key    string
+		dir    int // of the sibling the leaf of the key goes to
+		want   []int
+	}{
+		// the middle leaf fits in its left sibling
+		{"merge left", []int{3, 3, 33}, "key003", -1, []int{5, 33}},
+		// the first leaf has no left sibling
+		{"merge right", []int{3, 3, 33}, "key000", +1, []int{5, 33}},
+		// the left sibling is too full to absorb it, keys move across
+		{"borrow", []int{33, 3, 33}, "key033", -1, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tree := testLeafTree(c.leaves...)
+			root := BNode(tree.get(tree.root))
+			idx := nodeLookupLE(tree, root, []byte(c.key))
+			leaf := BNode(tree.get(root.getPtr(idx)))
+			updated := BNode(make([]byte, BTREE_PAGE_SIZE))
+			leafDelete(updated, leaf, nodeLookupLE(tree, leaf, []byte(c.key)))
+			if dir, _ := shouldMerge(tree, root, idx, updated); dir != c.dir {
+				t.Fatalf("shouldMerge is %d, want %d", dir, c.dir)
+			}
+
+			if ok, _ := tree.Delete([]byte(c.key)); !ok {
+				t.Fatal("key not found")
+			}
+			if err := tree.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			sizes := leafSizes(tree)
+			if c.want != nil && fmt.Sprint(sizes) != fmt.Sprint(c.want) {
+				t.Fatalf("leaves of %v KVs, want %v", sizes, c.want)
+			}
+			if c.want == nil && (len(sizes) != 3 || sizes[1] <= 2) {
+				t.Fatalf("leaves of %v KVs, the middle one did not borrow", sizes)
+			}
+			if _, ok := tree.Get([]byte(c.key)); ok {
+				t.Fatal("the key is still there")
+			}
+			n := -2 // the dummy key and the deleted one
+			for _, size := range c.leaves {
+				n += size
+			}
+			if tree.Len() != n {
+				t.Fatalf("%d keys, want %d", tree.Len(), n)
+			}
+		})
+	}
+}
+
+func TestDeleteShrinksRoot(t *testing.T) {
+	tree := testLeafTree(3, 3)
+	if ok, _ := tree.Delete([]byte("key000")); !ok {
+		t.Fatal("key not found")
+	}
+	if root := BNode(tree.get(tree.root)); root.btype() != BNODE_LEAF || root.nkeys() != 5 {
+		t.Fatalf("root of type %d with %d keys", root.btype(), root.nkeys())
+	}
+	for _, key := range []string{"key000", "zzz"} {
+		if ok, _ := tree.Delete([]byte(key)); ok {
+			t.Fatal("deleted a missing key")
+		}
+	}
+}
+
+func TestLeafDelete(t *testing.T) {
+	kvs := testKVs(5, 10)
+	old := testNode(BNODE_LEAF, kvs)
+	for _, idx := range []int{0, 2, 4} {
+		new := BNode(make([]byte, BTREE_PAGE_SIZE))
+		leafDelete(new, old, uint16(idx))
+		want := append(append([]KV{}, kvs[:idx]...), kvs[idx+1:]...)
+		ptrs := []uint64{}
+		for i := range kvs {
+			if i != idx {
+				ptrs = append(ptrs, uint64(100+i))
+			}
+		}
+		checkNode(t, new, want, ptrs)
+		if new.btype() != BNODE_LEAF || new.nbytes() >= old.nbytes() {
+			t.Fatalf("deleting %d: type %d, %d bytes", idx, new.btype(), new.nbytes())
+		}
+	}
+}
+
+func TestNodeMerge(t *testing.T) {
+	tree := NewMemTree()
+	kvs := testKVs(32, 100)
+	left, right := testNode(BNODE_LEAF, kvs[:16]), testNode(BNODE_LEAF, kvs[16:])
+	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	nodeMerge(tree, new, left, right)
+	ptrs := make([]uint64, 32)
+	for i := range ptrs {
+		ptrs[i] = uint64(100 + i%16)
+	}
+	checkNode(t, new, kvs, ptrs)
+
+	// the result must fit in a page
+	defer func() {
+		if recover() == nil {
+			t.Fatal("merged 2 full nodes")
+		}
+	}()
+	full := testNode(BNODE_LEAF, testKVs(30, 100))
+	nodeMerge(tree, BNode(make([]byte, 2*BTREE_PAGE_SIZE)), full, full)
+}
+
+func TestUpdate(t *testing.T) {
+	tree := testTree(2000)
+	hash := tree.ContentHash()
+	if ok, err := tree.Update([]byte("key000100x"), []byte("new")); ok || err != nil {
+		t.Fatalf("absent key: %v %v", ok, err)
+	}
+	if !bytes.Equal(tree.ContentHash(), hash) || tree.Len() != 2000 {
+		t.Fatal("updating an absent key changed the tree")
+	}
+
+	stats := tree.Stats()
+	for _, val := range [][]byte{bytes.Repeat([]byte("x"), 100), []byte("shorter"), make([]byte, 500)} {
+		if ok, err := tree.Update([]byte("key000100"), val); !ok || err != nil {
+			t.Fatalf("present key: %v %v", ok, err)
+		}
+		if got, _ := tree.Get([]byte("key000100")); !bytes.Equal(got, val) {
+			t.Fatalf("%q, want %q", got, val)
+		}
+		if tree.Len() != 2000 {
+			t.Fatalf("%d keys", tree.Len())
+		}
+		// a value of the same size is replaced in place
+		if len(val) == 100 && tree.Stats() != stats {
+			t.Fatalf("%+v, was %+v", tree.Stats(), stats)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeafUpdateVal(t *testing.T) {
+	kvs := testKVs(10, 20)
+	old := testNode(BNODE_LEAF, kvs)
+	val := bytes.Repeat([]byte("n"), 20)
+
+	// the same bytes as rebuilding the leaf, at the same offsets
+	fast, slow := BNode(make([]byte, 2*BTREE_PAGE_SIZE)), BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	leafUpdateVal(fast, old, 4, val)
+	leafUpdate(slow, old, 4, kvs[4].Key, val, old.getPtr(4))
+	if !bytes.Equal(fast[:fast.nbytes()], slow[:slow.nbytes()]) {
+		t.Fatal("the leaves differ")
+	}
+	for i := uint16(1); i <= old.nkeys(); i++ {
+		if fast.getOffset(i) != old.getOffset(i) {
+			t.Fatalf("offset %d moved from %d to %d", i, old.getOffset(i), fast.getOffset(i))
+		}
+	}
+	kvs[4].Val = val
+	checkNode(t, fast, kvs, nil)
+
+	// the leaf of an updated key keeps its layout only for a value of the
+	// same size
+	tree := testTree(1000)
+	leafOf := func(key string) BNode {
+		node := BNode(tree.get(tree.root))
+		for node.btype() == BNODE_NODE {
+			node = tree.get(node.getPtr(nodeLookupLE(tree, node, []byte(key))))
+		}
+		return node
+	}
+	before := bytes.Clone(leafOf("key000500"))
+	tree.Update([]byte("key000500"), bytes.Repeat([]byte("n"), 100))
+	after := leafOf("key000500")
+	for i := uint16(1); i <= after.nkeys(); i++ {
+		if after.getOffset(i) != BNode(before).getOffset(i) {
+			t.Fatalf("offset %d moved", i)
+		}
+	}
+	tree.Update([]byte("key000500"), []byte("short"))
+	if got, _ := tree.Get([]byte("key000500")); string(got) != "short" {
+		t.Fatalf("%q", got)
+	}
+	if leafOf("key000500").nbytes() != BNode(before).nbytes()-95 {
+		t.Fatal("the leaf didn't shrink")
+	}
+}
+
+func TestInsertIfAbsent(t *testing.T) {
+	tree := NewMemTree()
+	if ok, err := tree.InsertIfAbsent([]byte("a"), []byte("first")); !ok || err != nil {
+		t.Fatalf("first call: %v %v", ok, err)
+	}
+	hash := tree.ContentHash()
+	if ok, err := tree.InsertIfAbsent([]byte("a"), []byte("second")); ok || err != nil {
+		t.Fatalf("second call: %v %v", ok, err)
+	}
+	if val, _ := tree.Get([]byte("a")); string(val) != "first" || tree.Len() != 1 {
+		t.Fatalf("%q, %d keys", val, tree.Len())
+	}
+	if !bytes.Equal(tree.ContentHash(), hash) {
+		t.Fatal("the tree changed")
+	}
+	if ok, err := tree.InsertIfAbsent(nil, []byte("x")); ok || err == nil {
+		t.Fatalf("empty key: %v %v", ok, err)
+	}
+}
+
+func TestInsertReplacesDuplicate(t *testing.T) {
+	tree := testTree(2000)
+	for _, val := range []string{"first", "second"} {
+		if err := tree.Insert([]byte("key000500"), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, _ := tree.Get([]byte("key000500")); string(val) != "second" {
+		t.Fatalf("%q", val)
+	}
+	n := 0
+	for _, key := range iterKeys(tree.Iterate()) {
+		if key == "key000500" {
+			n++
+		}
+	}
+	if n != 1 || tree.Len() != 2000 {
+		t.Fatalf("%d copies of the key, %d keys", n, tree.Len())
+	}
+
+	// in a single leaf
+	old := testNode(BNODE_LEAF, testKVs(3, 10))
+	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	leafUpdate(new, old, 1, []byte("key01"), []byte("new"), 0)
+	kvs := testKVs(3, 10)
+	kvs[1].Val = []byte("new")
+	checkNode(t, new, kvs, nil)
+}
+
+func TestMinMax(t *testing.T) {
+	tree := NewMemTree()
+	if _, _, ok := tree.Min(); ok {
+		t.Fatal("Min of an empty tree")
+	}
+	if _, _, ok := tree.Max(); ok {
+		t.Fatal("Max of an empty tree")
+	}
+
+	tree.Insert([]byte("only"), []byte("v"))
+	for _, f := range []func() ([]byte, []byte, bool){tree.Min, tree.Max} {
+		if key, val, ok := f(); !ok || string(key) != "only" || string(val) != "v" {
+			t.Fatalf("single key: %q=%q %v", key, val, ok)
+		}
+	}
+
+	tree = testTree(3000)
+	if key, val, ok := tree.Min(); !ok || string(key) != "key000000" || len(val) != 100 {
+		t.Fatalf("Min: %q %v", key, ok)
+	}
+	if key, val, ok := tree.Max(); !ok || string(key) != "key002999" || len(val) != 100 {
+		t.Fatalf("Max: %q %v", key, ok)
+	}
+	// after the keys at the edges are deleted
+	tree.Delete([]byte("key000000"))
+	tree.Delete([]byte("key002999"))
+	if key, _, _ := tree.Min(); string(key) != "key000001" {
+		t.Fatalf("Min: %q", key)
+	}
+	if key, _, _ := tree.Max(); string(key) != "key002998" {
+		t.Fatalf("Max: %q", key)
+	}
+}
+
+// the linear scan nodeLookupLE replaced
+func nodeLookupLELinear(tree *BTree, node BNode, key []byte) uint16 {
+	found := uint16(0)
+	for i := uint16(1); i < node.nkeys(); i++ {
+		if tree.compare(node.getKey(i), key) > 0 {
+			break
+		}
+		found = i
+	}
+	return found
+}
+
+// a leaf of as many short keys as fit in a page: "", "a0000", "a0002", ...
+func wideNode() BNode {
+	kvs := []KV{{}}
+	for i := 0; len(kvs) < (BTREE_PAGE_SIZE-HEADER)/(14+5); i++ {
+		kvs = append(kvs, KV{Key: []byte(fmt.Sprintf("a%04d", 2*i))})
+	}
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	node.setHeader(BNODE_LEAF, uint16(len(kvs)))
+	for i, kv := range kvs {
+		nodeAppendKV(node, uint16(i), 0, kv.Key, kv.Val)
+	}
+	return node
+}
+
+func TestNodeLookupLEMatchesLinear(t *testing.T) {
+	tree := NewMemTree()
+	node := wideNode()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("a%04d", rng.Intn(500)))
+		key = key[:1+rng.Intn(len(key))] // prefixes sort between the keys
+		if got, want := nodeLookupLE(tree, node, key), nodeLookupLELinear(tree, node, key); got != want {
+			t.Fatalf("%q: %d, want %d", key, got, want)
+		}
+	}
+	for _, key := range []string{"", "0", "z"} {
+		if got, want := nodeLookupLE(tree, node, []byte(key)), nodeLookupLELinear(tree, node, []byte(key)); got != want {
+			t.Fatalf("%q: %d, want %d", key, got, want)
+		}
+	}
+}
+
+func BenchmarkNodeLookupLE(b *testing.B) {
+	tree := NewMemTree()
+	node := wideNode()
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("a%04d", i*7%(2*int(node.nkeys()))))
+	}
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			nodeLookupLE(tree, node, keys[i%len(keys)])
+		}
+	})
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			nodeLookupLELinear(tree, node, keys[i%len(keys)])
+		}
+	})
+}
+
+func TestDeleteRange(t *testing.T) {
+	tree := testTree(5000)
+	leaves := tree.Stats().Leaves
+	if n, err := tree.DeleteRange([]byte("key001000"), []byte("key003999")); n != 3000 || err != nil {
+		t.Fatalf("deleted %d keys: %v", n, err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLeak(t, tree)
+	if n := tree.Stats().Leaves; n > leaves*2/5+1 {
+		t.Fatalf("%d leaves left of %d", n, leaves)
+	}
+	keys := iterKeys(tree.Iterate())
+	if len(keys) != 2000 || keys[999] != "key000999" || keys[1000] != "key004000" {
+		t.Fatalf("%d keys left", len(keys))
+	}
+
+	if n, err := tree.DeleteRange([]byte("key001000"), []byte("key003999")); n != 0 || err != nil {
+		t.Fatalf("deleted %d keys again: %v", n, err)
+	}
+	if n, err := tree.DeleteRange([]byte("a"), []byte("z")); n != 2000 || err != nil || tree.Len() != 0 {
+		t.Fatalf("deleted %d keys, %d left: %v", n, tree.Len(), err)
+	}
+}
+
+func TestWouldSplit(t *testing.T) {
+	tree := NewMemTree()
+	if tree.WouldSplit([]byte("a"), nil) {
+		t.Fatal("an empty tree would split")
+	}
+	// a single leaf with room for about 200 more bytes
+	val := make([]byte, 100)
+	for i := 0; tree.root == 0 || BNode(tree.get(tree.root)).nbytes() <= BTREE_PAGE_SIZE-300; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%03d", i)), val)
+	}
+	leaf := BNode(tree.get(tree.root))
+	free := BTREE_PAGE_SIZE - int(leaf.nbytes())
+	if leaf.btype() != BNODE_LEAF {
+		t.Fatal("the tree has more than 1 leaf")
+	}
+
+	hash := tree.ContentHash()
+	small, large := make([]byte, free-14-20), make([]byte, free)
+	if tree.WouldSplit([]byte("new"), small) {
+		t.Fatalf("a value of %d bytes would split, %d bytes are free", len(small), free)
+	}
+	if !tree.WouldSplit([]byte("new"), large) {
+		t.Fatalf("a value of %d bytes would fit", len(large))
+	}
+	// the size of an updated value replaces the old one
+	if tree.WouldSplit([]byte("key000"), make([]byte, 100+len(small))) {
+		t.Fatal("the update would split")
+	}
+	// a larger value goes to overflow pages
+	if tree.WouldSplit([]byte("new"), make([]byte, 10000)) {
+		t.Fatal("an overflow value would split")
+	}
+	if !bytes.Equal(tree.ContentHash(), hash) {
+		t.Fatal("the tree changed")
+	}
+
+	if err := tree.Insert([]byte("new"), small); err != nil {
+		t.Fatal(err)
+	}
+	if BNode(tree.get(tree.root)).btype() != BNODE_LEAF {
+		t.Fatal("the insert split the leaf")
+	}
+}
+
+func TestClear(t *testing.T) {
+	tree := testTree(3000)
+	tree.Insert([]byte("big"), make([]byte, 10000))
+	if err := tree.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i += 100 {
+		if _, ok := tree.Get([]byte(fmt.Sprintf("key%06d", i))); ok {
+			t.Fatalf("key%06d is still there", i)
+		}
+	}
+	if stats := tree.Stats(); stats.Keys != 0 || tree.Len() != 0 {
+		t.Fatalf("%+v, Len %d", stats, tree.Len())
+	}
+	if n := len(tree.store.(*MemStore).pages); n != 0 {
+		t.Fatalf("%d pages left", n)
+	}
+	if err := tree.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree is usable again
+	tree.Insert([]byte("a"), []byte("b"))
+	if val, _ := tree.Get([]byte("a")); string(val) != "b" || tree.Len() != 1 {
+		t.Fatalf("%q, %d keys", val, tree.Len())
+	}
+}
+
+func TestLenTracksKeys(t *testing.T) {
+	tree := NewMemTree()
+	model := map[string]bool{}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%04d", rng.Intn(3000))
+		switch rng.Intn(4) {
+		case 0, 1:
+			tree.Insert([]byte(key), make([]byte, rng.Intn(200)))
+			model[key] = true
+		case 2:
+			if ok, _ := tree.Delete([]byte(key)); ok != model[key] {
+				t.Fatalf("Delete %s", key)
+			}
+			delete(model, key)
+		case 3:
+			tree.InsertIfAbsent([]byte(key), nil)
+			model[key] = true
+		}
+		if tree.Len() != len(model) {
+			t.Fatalf("op %d: Len %d, want %d", i, tree.Len(), len(model))
+		}
+	}
+	// Verify checks the counter against the keys
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := tree.Begin()
+	tx.Insert([]byte("new"), nil)
+	tx.Rollback()
+	if tree.Len() != len(model) {
+		t.Fatalf("Len %d after a rollback, want %d", tree.Len(), len(model))
+	}
+}
+
+func TestSplitPolicyFill(t *testing.T) {
+	fill := func(policy int, keys [][]byte) float64 {
+		tree := NewMemTree()
+		tree.SplitPolicy = policy
+		for _, key := range keys {
+			tree.Insert(key, make([]byte, 16))
+		}
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		return tree.Stats().Fill
+	}
+	keys := sequentialKeys(10000)
+	half, appended := fill(SPLIT_HALF, keys), fill(SPLIT_APPEND, keys)
+	if half > 0.6 || appended < 0.9 {
+		t.Fatalf("sequential inserts fill %.2f with SPLIT_HALF, %.2f with SPLIT_APPEND", half, appended)
+	}
+
+	// only the splits of the last node are affected
+	shuffled := make([][]byte, len(keys))
+	for i := range keys {
+		shuffled[i] = keys[i*7919%len(keys)]
+	}
+	half, appended = fill(SPLIT_HALF, shuffled), fill(SPLIT_APPEND, shuffled)
+	if diff := half - appended; diff > 0.05 || diff < -0.05 {
+		t.Fatalf("random inserts fill %.2f with SPLIT_HALF, %.2f with SPLIT_APPEND", half, appended)
+	}
+}
+
+func TestExistsAgreesWithGet(t *testing.T) {
+	tree := NewMemTree()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%05d", rng.Intn(10000))), make([]byte, rng.Intn(5000)))
+	}
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%05d", rng.Intn(10000)))
+		if _, ok := tree.Get(key); tree.Exists(key) != ok {
+			t.Fatalf("%s: Get %v, Exists %v", key, ok, !ok)
+		}
+	}
+	// Exists doesn't read the overflow pages of a large value
+	tree.Insert([]byte("big"), make([]byte, 20000))
+	height := tree.Stats().Height
+	reads := countReads(tree)
+	if !tree.Exists([]byte("big")) || *reads != height {
+		t.Fatalf("%d reads", *reads)
+	}
+	if tree.Exists(nil) || NewMemTree().Exists([]byte("a")) {
+		t.Fatal("found a missing key")
+	}
+}
+
+func TestCaseInsensitiveCmp(t *testing.T) {
+	tree := NewMemTree()
+	tree.Cmp = func(a []byte, b []byte) int {
+		return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+	}
+	for _, key := range []string{"banana", "Apple", "cherry", "apricot", "Blueberry"} {
+		tree.Insert([]byte(key), []byte(key))
+	}
+	for i := 0; i < 2000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("Key%04d", i)), nil)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := iterKeys(tree.Iterate())
+	if want := "[Apple apricot banana Blueberry cherry Key0000]"; fmt.Sprint(keys[:6]) != want {
+		t.Fatalf("%v, want %s", keys[:6], want)
+	}
+	// keys differing by case are the same key
+	if val, ok := tree.Get([]byte("APPLE")); !ok || string(val) != "Apple" {
+		t.Fatalf("APPLE: %q %v", val, ok)
+	}
+	tree.Insert([]byte("BANANA"), []byte("new"))
+	if val, _ := tree.Get([]byte("banana")); string(val) != "new" || tree.Len() != 2005 {
+		t.Fatalf("%q, %d keys", val, tree.Len())
+	}
+	if ok, _ := tree.Delete([]byte("key1000")); !ok || tree.Exists([]byte("KEY1000")) {
+		t.Fatal("Delete")
+	}
+	if n := len(iterKeys(tree.Range([]byte("KEY0100"), []byte("key0199"), RANGE_INCLUSIVE))); n != 100 {
+		t.Fatalf("%d keys in the range", n)
+	}
+}
+
+func TestDeleteCollapsesHeight(t *testing.T) {
+	tree := testTree(20000)
+	if h := tree.Stats().Height; h < 3 {
+		t.Fatalf("height %d", h)
+	}
+	for i := 0; i < 19995; i++ {
+		if ok, _ := tree.Delete([]byte(fmt.Sprintf("key%06d", i*7919%20000))); !ok {
+			t.Fatalf("key%06d not found", i*7919%20000)
+		}
+	}
+	stats := tree.Stats()
+	if stats.Height != 1 || stats.Nodes != 1 || stats.Keys != 5 {
+		t.Fatalf("%+v", stats)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLeak(t, tree)
+}
+
+func TestInsertGrowsRoot(t *testing.T) {
+	tree := NewMemTree()
+	// in decreasing order, so the minimum changes with every insert
+	for i := 0; tree.root == 0 || BNode(tree.get(tree.root)).btype() == BNODE_LEAF; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", 1000-i)), []byte("value"))
+	}
+	root := BNode(tree.get(tree.root))
+	if root.nkeys() != 2 || tree.Stats().Height != 2 {
+		t.Fatalf("a root of %d kids, height %d", root.nkeys(), tree.Stats().Height)
+	}
+	// the first kid starts with the dummy key, the minimum of all the keys
+	first := BNode(tree.get(root.getPtr(0)))
+	if len(root.getKey(0)) != 0 || len(first.getKey(0)) != 0 {
+		t.Fatalf("first keys %q and %q", root.getKey(0), first.getKey(0))
+	}
+	min, _, _ := tree.Min()
+	if !bytes.Equal(first.getKey(1), min) {
+		t.Fatalf("Min is %q, the first kid starts with %q", min, first.getKey(1))
+	}
+	second := BNode(tree.get(root.getPtr(1)))
+	if !bytes.Equal(root.getKey(1), second.getKey(0)) {
+		t.Fatalf("the parent key %q of a kid starting with %q", root.getKey(1), second.getKey(0))
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterDelete(t *testing.T) {
+	tree := testTree(3000)
+	calls := 0
+	n, err := tree.FilterDelete(func(key []byte, val []byte) bool {
+		calls++
+		return (key[len(key)-1]-'0')%2 == 0
+	})
+	if n != 1500 || err != nil || calls != 3000 || tree.Len() != 1500 {
+		t.Fatalf("deleted %d keys in %d calls, %d left: %v", n, calls, tree.Len(), err)
+	}
+	keys := iterKeys(tree.Iterate())
+	for i, key := range keys {
+		if key != fmt.Sprintf("key%06d", 2*i+1) {
+			t.Fatalf("key %d is %s", i, key)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLeak(t, tree)
+
+	if n, err := tree.FilterDelete(func([]byte, []byte) bool { return false }); n != 0 || err != nil {
+		t.Fatalf("deleted %d keys: %v", n, err)
+	}
+}
+
+func TestKVSizeLimits(t *testing.T) {
+	tree := NewMemTree()
+	key := bytes.Repeat([]byte("k"), BTREE_MAX_KEY_SIZE)
+	val := bytes.Repeat([]byte("v"), BTREE_MAX_VAL_SIZE)
+	if err := tree.Insert(key, val); err != nil {
+		t.Fatal(err)
+	}
+	// stored in the leaf, next to the dummy key
+	root := BNode(tree.get(tree.root))
+	if root.btype() != BNODE_LEAF || root.nkeys() != 2 || root.getPtr(1) != 0 {
+		t.Fatalf("type %d with %d keys", root.btype(), root.nkeys())
+	}
+	if got, ok := tree.Get(key); !ok || !bytes.Equal(got, val) {
+		t.Fatalf("Get: %d bytes", len(got))
+	}
+	// a second KV at the limits splits the leaf
+	key2 := append(bytes.Clone(key[1:]), 'l')
+	if err := tree.Insert(key2, val); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	long := append(bytes.Clone(key), 'k')
+	if err := tree.Insert(long, nil); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("Insert: %v", err)
+	}
+	if ok, err := tree.InsertIfAbsent(long, nil); ok || err == nil {
+		t.Fatal("InsertIfAbsent accepted a key over the limit")
+	}
+	if _, ok := tree.Get(long); ok || tree.Len() != 2 {
+		t.Fatalf("%d keys", tree.Len())
+	}
+}
+
+func TestEmptyKeyRejected(t *testing.T) {
+	tree := testTree(100)
+	if err := tree.Insert(nil, []byte("x")); err == nil || !strings.Contains(err.Error(), "empty key") {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := tree.Insert([]byte{}, []byte("x")); err == nil {
+		t.Fatal("Insert accepted an empty key")
+	}
+	if ok, err := tree.Update(nil, []byte("x")); ok || err == nil {
+		t.Fatalf("Update: %v %v", ok, err)
+	}
+	if ok, err := tree.InsertIfAbsent(nil, []byte("x")); ok || err == nil {
+		t.Fatalf("InsertIfAbsent: %v %v", ok, err)
+	}
+	if err := tree.InsertBatch([]KV{{Key: []byte("a")}, {Key: nil}}); err == nil {
+		t.Fatal("InsertBatch accepted an empty key")
+	}
+	// the dummy key is not served as a KV
+	if _, ok := tree.Get(nil); ok || tree.Exists(nil) {
+		t.Fatal("the empty key is found")
+	}
+	if ok, _ := tree.Delete(nil); ok {
+		t.Fatal("the empty key is deleted")
+	}
+	if tree.Len() != 100 {
+		t.Fatalf("%d keys", tree.Len())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	tree := testTree(1000)
+	big := bytes.Repeat([]byte("big"), 5000)
+	tree.Insert([]byte("big"), big)
+	small := []byte("small value")
+	tree.Insert([]byte("small"), small)
+
+	for _, want := range []struct {
+		key string
+		val []byte
+	}{{"small", small}, {"big", big}} {
+		for _, size := range []int{len(want.val) + 10, len(want.val), len(want.val) - 1, 0} {
+			dst := bytes.Repeat([]byte{0xee}, size)
+			n, ok := tree.GetInto([]byte(want.key), dst)
+			if !ok || n != len(want.val) {
+				t.Fatalf("%s into %d bytes: %d %v", want.key, size, n, ok)
+			}
+			// a value that doesn't fit is not copied
+			copied := size >= len(want.val)
+			if copied && !bytes.Equal(dst[:n], want.val) {
+				t.Fatalf("%s into %d bytes: wrong value", want.key, size)
+			}
+			if !copied && !bytes.Equal(dst, bytes.Repeat([]byte{0xee}, size)) {
+				t.Fatalf("%s into %d bytes: dst modified", want.key, size)
+			}
+		}
+	}
+	if n, ok := tree.GetInto([]byte("absent"), make([]byte, 10)); ok || n != 0 {
+		t.Fatalf("absent key: %d %v", n, ok)
+	}
+
+	dst := make([]byte, len(big))
+	keys := [][]byte{[]byte("small"), []byte("big")}
+	if allocs := testing.AllocsPerRun(100, func() {
+		tree.GetInto(keys[0], dst)
+		tree.GetInto(keys[1], dst)
+	}); allocs != 0 {
+		t.Fatalf("%.0f allocations", allocs)
+	}
+}
+
+func TestSplitAroundLargestKV(t *testing.T) {
+	// a full leaf, then a KV at the size limits in its middle makes a node
+	// of about 2 pages split in 3, each part fitting a page
+	tree := NewMemTree()
+	for i := 0; i < 33; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 100))
+	}
+	if root := BNode(tree.get(tree.root)); root.btype() != BNODE_LEAF {
+		t.Fatal("the tree has more than 1 leaf")
+	}
+	key := append([]byte("key016"), bytes.Repeat([]byte("k"), BTREE_MAX_KEY_SIZE-6)...)
+	val := bytes.Repeat([]byte("v"), BTREE_MAX_VAL_SIZE)
+	if err := tree.Insert(key, val); err != nil {
+		t.Fatal(err)
+	}
+	if stats := tree.Stats(); stats.Height != 2 || stats.Leaves != 3 {
+		t.Fatalf("%+v", stats)
+	}
+	// the large KV takes the middle leaf
+	root := BNode(tree.get(tree.root))
+	middle := BNode(tree.get(root.getPtr(1)))
+	if idx := nodeLookupLE(tree, middle, key); !bytes.Equal(middle.getKey(idx), key) {
+		t.Fatal("the large KV is not in the middle leaf")
+	}
+	if got, ok := tree.Get(key); !ok || !bytes.Equal(got, val) {
+		t.Fatal("Get of the large KV")
+	}
+
+	// past the value limit, the value goes to overflow pages instead
+	huge := bytes.Repeat([]byte("h"), 5*BTREE_PAGE_SIZE)
+	key[len(key)-1] = 'l'
+	if err := tree.Insert(key, huge); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := tree.Get(key); !ok || !bytes.Equal(got, huge) {
+		t.Fatal("Get of the huge value")
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLeak(t, tree)
+}
+
+func TestValidateSizes(t *testing.T) {
+	for _, c := range []struct {
+		pageSize, maxKey, maxVal int
+		err                      string // "" if valid
+	}{
+		{BTREE_PAGE_SIZE, BTREE_MAX_KEY_SIZE, BTREE_MAX_VAL_SIZE, ""},
+		{8192, 4000, 4000, ""},
+		{4096, 1000, 4000, "can't hold a node"},
+		{1024, BTREE_MAX_KEY_SIZE, BTREE_MAX_VAL_SIZE, "can't hold a node"},
+		{6000, 1000, 3000, "not a power of 2"},
+		{1 << 16, 1000, 3000, "too large"},
+	} {
+		err := validateSizes(c.pageSize, c.maxKey, c.maxVal)
+		if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+			t.Fatalf("%d/%d/%d: %v, want %q", c.pageSize, c.maxKey, c.maxVal, err, c.err)
+		}
+	}
+
+	// the constructors return the error instead of panicking
+	if tree, err := NewMemTreeSize(1024); err == nil || tree != nil {
+		t.Fatal("NewMemTreeSize accepted 1K pages")
+	}
+	if _, err := OpenFileSize(filepath.Join(t.TempDir(), "db"), 1000); err == nil {
+		t.Fatal("OpenFileSize accepted pages of 1000 bytes")
+	}
+}
+
+func TestCheckedKey(t *testing.T) {
+	kvs := testKVs(3, 10)
+	node := testNode(BNODE_LEAF, kvs)[:BTREE_PAGE_SIZE]
+	for i := range kvs {
+		if key, err := node.checkedKey(uint16(i)); err != nil || !bytes.Equal(key, kvs[i].Key) {
+			t.Fatalf("key %d: %q %v", i, key, err)
+		}
+	}
+
+	// an oversized key length in the KV of the last key
+	bad := BNode(bytes.Clone(node))
+	binary.LittleEndian.PutUint16(bad[bad.kvPos(2):], 0xffff)
+	if _, err := bad.checkedKey(2); err == nil || !strings.Contains(err.Error(), "out of the node") {
+		t.Fatalf("oversized key: %v", err)
+	}
+	if _, err := bad.checkedKey(1); err != nil {
+		t.Fatalf("the other keys: %v", err)
+	}
+	if err := verifyNode(NewMemTree(), bad); err == nil {
+		t.Fatal("the corrupt page verified")
+	}
+
+	for _, c := range []struct {
+		name string
+		node BNode
+		idx  uint16
+	}{
+		{"truncated header", node[:HEADER-1], 0},
+		{"index past nkeys", node, 3},
+		{"truncated pointers", node[:HEADER+10], 2},
+		{"truncated KVs", node[:node.kvPos(2)+2], 2},
+	} {
+		if _, err := c.node.checkedKey(c.idx); err == nil {
+			t.Fatalf("%s: no error", c.name)
+		}
+	}
+	huge := BNode(bytes.Clone(node))
+	huge.setHeader(BNODE_LEAF, 0xffff)
+	if _, err := huge.checkedKey(0); err == nil {
+		t.Fatal("too many keys: no error")
+	}
+}
+
+func TestEmptyNode(t *testing.T) {
+	tree := NewMemTree()
+	kvs := testKVs(3, 10)
+	full := testNode(BNODE_LEAF, kvs)
+	for _, btype := range []uint16{BNODE_LEAF, BNODE_LEAF | BNODE_PREFIX, BNODE_NODE} {
+		empty := BNode(make([]byte, BTREE_PAGE_SIZE))
+		empty.setHeader(btype, 0)
+		if empty.nbytes() != HEADER || empty.kvPos(0) != HEADER || empty.getOffset(0) != 0 {
+			t.Fatalf("type %d: nbytes %d, kvPos %d", btype, empty.nbytes(), empty.kvPos(0))
+		}
+		if empty.maxBytes() != HEADER || empty.anchor() != 0 {
+			t.Fatalf("type %d: maxBytes %d, anchor %d", btype, empty.maxBytes(), empty.anchor())
+		}
+		if idx := nodeLookupLE(tree, empty, []byte("key")); idx != 0 {
+			t.Fatalf("type %d: lookup %d", btype, idx)
+		}
+		if _, err := empty.checkedKey(0); err == nil {
+			t.Fatalf("type %d: a key in an empty node", btype)
+		}
+		if info := nodeInfo(tree, empty); info.Keys != 0 || info.Used != HEADER || !info.Underfull {
+			t.Fatalf("type %d: %+v", btype, info)
+		}
+		copied := BNode(make([]byte, BTREE_PAGE_SIZE))
+		copied.setHeader(btype, 0)
+		nodeAppendRange(copied, empty, 0, 0, 0)
+		if copied.nbytes() != HEADER {
+			t.Fatalf("type %d: %d bytes copied", btype, copied.nbytes())
+		}
+	}
+
+	// an empty leaf is filled again or merged away like any other
+	empty := BNode(make([]byte, BTREE_PAGE_SIZE))
+	empty.setHeader(BNODE_LEAF, 0)
+	inserted := BNode(make([]byte, BTREE_PAGE_SIZE))
+	leafInsert(inserted, empty, 0, kvs[0].Key, kvs[0].Val, 0)
+	checkNode(t, inserted, kvs[:1], nil)
+	for _, pair := range [][2]BNode{{empty, full}, {full, empty}} {
+		merged := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+		nodeMerge(tree, merged, pair[0], pair[1])
+		if !bytes.Equal(merged[:merged.nbytes()], full[:full.nbytes()]) {
+			t.Fatal("merging with an empty leaf changed the KVs")
+		}
+	}
+	// the last key left of a leaf
+	deleted := BNode(make([]byte, BTREE_PAGE_SIZE))
+	leafDelete(deleted, inserted, 0)
+	if deleted.nkeys() != 0 || deleted.nbytes() != HEADER {
+		t.Fatalf("%d keys, %d bytes", deleted.nkeys(), deleted.nbytes())
+	}
+}
+
+func TestMergeFill(t *testing.T) {
+	// leaves of 15 KVs take less than half a page, so the first delete
+	// merges them by default
+	tree := testLeafTree(15, 15)
+	tree.Delete([]byte("key020"))
+	if stats := tree.Stats(); stats.Height != 1 {
+		t.Fatalf("%+v", stats)
+	}
+
+	// below a quarter of a page, it takes 7 deletes
+	tree = testLeafTree(15, 15)
+	tree.MergeFill = 0.25
+	for i := 0; i < 6; i++ {
+		tree.Delete([]byte(fmt.Sprintf("key%03d", i)))
+	}
+	if sizes := leafSizes(tree); fmt.Sprint(sizes) != "[9 15]" {
+		t.Fatalf("leaves %v", sizes)
+	}
+	tree.Delete([]byte("key006"))
+	if tree.Stats().Height != 1 || tree.Len() != 22 {
+		t.Fatalf("%+v", tree.Stats())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// with a tiny fill, only a leaf left empty is merged
+	tree = testLeafTree(2, 15)
+	tree.MergeFill = 0.01
+	tree.Delete([]byte("key000"))
+	if sizes := leafSizes(tree); fmt.Sprint(sizes) != "[1 15]" {
+		t.Fatalf("leaves %v", sizes)
+	}
+	tree = testLeafTree(15, 1)
+	tree.MergeFill = 0.01
+	tree.Delete([]byte("key014"))
+	if stats := tree.Stats(); stats.Height != 1 {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+// merges and splits per update when deleting and inserting back random
+// keys, which the merges at a high fill undo and redo over and over
+func BenchmarkMergeFill(b *testing.B) {
+	for _, fill := range []float64{0.5, 0.4, 0.25} {
+		b.Run(fmt.Sprintf("fill-%.2f", fill), func(b *testing.B) {
+			tree := NewMemTree()
+			tree.MergeFill = fill
+			val := make([]byte, 100)
+			for i := 0; i < 20000; i++ {
+				tree.insert([]byte(fmt.Sprintf("key%06d", i*7919%20000)), val, MODE_UPSERT)
+			}
+			obs := &countObserver{}
+			tree.Observe(obs)
+			rng := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := []byte(fmt.Sprintf("key%06d", rng.Intn(20000)))
+				tree.delete(key)
+				tree.insert(key, val, MODE_UPSERT)
+			}
+			b.ReportMetric(float64(obs.merges+obs.splits)/float64(2*b.N), "churn/op")
+		})
+	}
+}
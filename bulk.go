@@ -0,0 +1,113 @@
+package btree
+
+import (
+	"errors"
+)
+
+// BulkLoad builds the tree from KVs sorted in ascending key order.
+// instead of inserting keys one by one, it packs the leaves bottom-up,
+// each one as full as possible, and then builds the internal levels above.
+// the tree must be empty.
+func (tree *BTree) BulkLoad(kvs []KV) error {
+	if tree.root != 0 {
+		return errors.New("bulk load into a non-empty tree")
+	}
+	for i, kv := range kvs {
+		if err := checkKV(kv.Key, kv.Val); err != nil {
+			return err
+		}
+		if i > 0 && tree.compare(kvs[i-1].Key, kv.Key) >= 0 {
+			return errors.New("bulk load input is not sorted")
+		}
+	}
+	tree.bulkLoad(kvs)
+	return tree.commit()
+}
+
+// NewFromSorted returns a tree on an empty store bulk loaded with KVs sorted
+// in ascending key order, e.g. to load a dump. see BulkLoad
+func NewFromSorted(store Store, kvs []KV) (*BTree, error) {
+	tree := newTree(store)
+	if err := tree.BulkLoad(kvs); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// the BulkLoad() without the checks and the commit
+func (tree *BTree) bulkLoad(kvs []KV) {
+	if len(kvs) == 0 {
+		return
+	}
+
+	// the leaf level, starting with the dummy key
+	keys := make([][]byte, 0, len(kvs)+1)
+	vals := make([][]byte, 0, len(kvs)+1)
+	vptrs := make([]uint64, 0, len(kvs)+1)
+	keys, vals, vptrs = append(keys, nil), append(vals, nil), append(vptrs, 0)
+	for _, kv := range kvs {
+		val, vptr := tree.valEncode(kv.Val), uint64(0)
+		if len(val) > BTREE_MAX_VAL_SIZE {
+			vptr, val = tree.overflowWrite(val)
+		}
+		keys, vals, vptrs = append(keys, kv.Key), append(vals, val), append(vptrs, vptr)
+		if tree.obs != nil {
+			tree.obs.OnInsert()
+		}
+	}
+	keys, vals, ptrs := bulkLevel(tree, BNODE_LEAF|tree.leafFlags(), keys, vals, vptrs)
+
+	// the internal levels, until a single root is left
+	for len(ptrs) > 1 {
+		keys, vals, ptrs = bulkLevel(tree, BNODE_NODE|tree.nodeFlags(nil), keys, vals, ptrs)
+	}
+	tree.root = ptrs[0]
+	tree.count = len(kvs)
+}
+
+// pack the entries of a level into as few nodes as possible, returning
+// the first key, the value in the parent and the pointer of each allocated node
+func bulkLevel(
+	tree *BTree, btype uint16,
+	keys [][]byte, vals [][]byte, ptrs []uint64,
+) ([][]byte, [][]byte, []uint64) {
+	var nodeKeys, nodeVals [][]byte
+	var nodePtrs []uint64
+	for start := 0; start < len(keys); {
+		// take as many entries as fit in a page
+		end, size := start, HEADER
+		for end < len(keys) {
+			entry := 8 + 2 + 4 + len(keys[end])
+			if vals != nil {
+				entry += len(vals[end])
+			}
+			if btype&BNODE_PREFIX != 0 {
+				entry += 2 // the shared prefix length
+			}
+			if size+entry > int(tree.pageSize()) {
+				break
+			}
+			size += entry
+			end++
+		}
+
+		node := BNode(make([]byte, tree.pageSize()))
+		node.setHeader(btype, uint16(end-start))
+		for i := start; i < end; i++ {
+			var ptr uint64
+			var val []byte
+			if ptrs != nil {
+				ptr = ptrs[i]
+			}
+			if vals != nil {
+				val = vals[i]
+			}
+			nodeAppendKV(node, uint16(i-start), ptr, keys[i], val)
+		}
+		nodeKeys = append(nodeKeys, keys[start])
+		nodeVals = append(nodeVals, kidCountVal(tree.nodeFlags(nil), node))
+		nodePtrs = append(nodePtrs, tree.new(node))
+		start = end
+	}
+	return nodeKeys, nodeVals, nodePtrs
+}
@@ -0,0 +1,95 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+// KVs of increasing keys
+func sortedKVs(n int) []KV {
+	kvs := make([]KV, n)
+	for i := range kvs {
+		kvs[i] = KV{Key: []byte(fmt.Sprintf("key%08d", i)), Val: []byte(fmt.Sprint(i))}
+	}
+	return kvs
+}
+
+func TestBulkLoad(t *testing.T) {
+	kvs := sortedKVs(10000)
+	tree := NewMemTree()
+	if err := tree.BulkLoad(kvs); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for iter := tree.Iterate(); iter.Next(); i++ {
+		if string(iter.Key()) != string(kvs[i].Key) || string(iter.Val()) != string(kvs[i].Val) {
+			t.Fatalf("KV %d is %q=%q", i, iter.Key(), iter.Val())
+		}
+	}
+	if i != len(kvs) || tree.Len() != len(kvs) {
+		t.Fatalf("%d KVs, Len %d", i, tree.Len())
+	}
+
+	if err := tree.BulkLoad(sortedKVs(1)); err == nil {
+		t.Fatal("bulk loaded a non-empty tree")
+	}
+	unsorted := sortedKVs(100)
+	unsorted[50], unsorted[51] = unsorted[51], unsorted[50]
+	if err := NewMemTree().BulkLoad(unsorted); err == nil {
+		t.Fatal("bulk loaded unsorted KVs")
+	}
+	duplicate := sortedKVs(100)
+	duplicate[51] = duplicate[50]
+	if err := NewMemTree().BulkLoad(duplicate); err == nil {
+		t.Fatal("bulk loaded a key twice")
+	}
+}
+
+func TestNewFromSorted(t *testing.T) {
+	kvs := sortedKVs(20000)
+	tree, err := NewFromSorted(NewMemStore(), kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if !sameKVs(treeKVs(tree), kvs) {
+		t.Fatalf("%d keys", tree.Len())
+	}
+	// packed close to full, unlike one insert at a time
+	inserted := NewMemTree()
+	for _, kv := range kvs {
+		inserted.Insert(kv.Key, kv.Val)
+	}
+	stats := tree.Stats()
+	if stats.Fill < 0.9 || stats.Nodes >= inserted.Stats().Nodes*3/4 {
+		t.Fatalf("%+v, %+v inserted", stats, inserted.Stats())
+	}
+
+	unsorted := sortedKVs(100)
+	unsorted[10], unsorted[90] = unsorted[90], unsorted[10]
+	if tree, err := NewFromSorted(NewMemStore(), unsorted); err == nil || tree != nil {
+		t.Fatal("loaded unsorted KVs")
+	}
+}
+
+func BenchmarkLoadSorted(b *testing.B) {
+	kvs := sortedKVs(100000)
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NewMemTree().BulkLoad(kvs)
+		}
+	})
+	b.Run("insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := NewMemTree()
+			for _, kv := range kvs {
+				tree.Insert(kv.Key, kv.Val)
+			}
+		}
+	})
+}
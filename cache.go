@@ -0,0 +1,88 @@
+package btree
+
+import (
+	"container/list"
+	"sync"
+)
+
+// PageCache keeps recently read nodes in front of the get callback of a
+// tree, evicting the least recently used one when it's full. a page is
+// dropped from the cache when it's deallocated or allocated again, so a
+// reused page is never served with its old content.
+// it's safe for the concurrent reads of a SafeTree
+type PageCache struct {
+	mu      sync.Mutex
+	get     func(uint64) []byte // the wrapped callback
+	size    int                 // the maximum number of cached pages
+	lru     *list.List          // of *cacheEntry, most recently used first
+	entries map[uint64]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+type cacheEntry struct {
+	ptr  uint64
+	node BNode
+}
+
+// UseCache puts a cache of up to size pages in front of the page reads of
+// the tree. it must be set up before the tree is used
+func (tree *BTree) UseCache(size int) *PageCache {
+	cache := &PageCache{
+		get: tree.get, size: size,
+		lru: list.New(), entries: map[uint64]*list.Element{},
+	}
+	new, del := tree.new, tree.del
+	tree.get = cache.Get
+	tree.new = func(node []byte) uint64 {
+		ptr := new(node)
+		cache.invalidate(ptr)
+		return ptr
+	}
+	tree.del = func(ptr uint64) {
+		cache.invalidate(ptr)
+		del(ptr)
+	}
+	return cache
+}
+
+// Get dereferences a page pointer through the cache
+func (cache *PageCache) Get(ptr uint64) []byte {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[ptr]; ok {
+		cache.hits++
+		cache.lru.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).node
+	}
+
+	cache.misses++
+	node := BNode(cache.get(ptr))
+	if cache.size <= 0 {
+		return node
+	}
+	if cache.lru.Len() >= cache.size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).ptr)
+	}
+	cache.entries[ptr] = cache.lru.PushFront(&cacheEntry{ptr: ptr, node: node})
+	return node
+}
+
+// drop a page whose content is changing
+func (cache *PageCache) invalidate(ptr uint64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[ptr]; ok {
+		cache.lru.Remove(elem)
+		delete(cache.entries, ptr)
+	}
+}
+
+// Stats returns the number of reads served from the cache and the others
+func (cache *PageCache) Stats() (hits uint64, misses uint64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.hits, cache.misses
+}
@@ -0,0 +1,77 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPageCacheLRU(t *testing.T) {
+	pages := map[uint64][]byte{1: []byte("p1"), 2: []byte("p2"), 3: []byte("p3")}
+	tree := &BTree{
+		get: func(ptr uint64) []byte { return pages[ptr] },
+		new: func(node []byte) uint64 { pages[3] = node; return 3 }, // reuses page 3
+		del: func(ptr uint64) { delete(pages, ptr) },
+	}
+	cache := tree.UseCache(2)
+
+	for i, c := range []struct {
+		ptr          uint64
+		hits, misses uint64
+	}{
+		{1, 0, 1},
+		{2, 0, 2},
+		{1, 1, 2},
+		{3, 1, 3}, // evicts 2, the least recently used
+		{1, 2, 3},
+		{2, 2, 4},
+		{3, 2, 5},
+	} {
+		if got := tree.get(c.ptr); string(got) != fmt.Sprintf("p%d", c.ptr) {
+			t.Fatalf("read %d: %q", i, got)
+		}
+		if hits, misses := cache.Stats(); hits != c.hits || misses != c.misses {
+			t.Fatalf("read %d: %d hits, %d misses, want %d and %d", i, hits, misses, c.hits, c.misses)
+		}
+	}
+
+	// a page allocated again is not served with its old content
+	tree.del(3)
+	tree.new([]byte("new"))
+	if got := tree.get(3); string(got) != "new" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestPageCacheTree(t *testing.T) {
+	tree := testTree(5000)
+	cache := tree.UseCache(1000)
+	for i := 0; i < 5000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte("new"))
+	}
+	hits0, misses0 := cache.Stats()
+	for i := 0; i < 5000; i++ {
+		if val, _ := tree.Get([]byte(fmt.Sprintf("key%06d", i))); string(val) != "new" {
+			t.Fatalf("key%06d: %q", i, val)
+		}
+	}
+	// the whole tree fits in the cache
+	if hits, misses := cache.Stats(); hits-hits0 < 10*(misses-misses0) {
+		t.Fatalf("%d hits, %d misses", hits-hits0, misses-misses0)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// point reads over a tree with a cache of a tenth of its nodes,
+// the hits come from the internal nodes staying in the cache
+func BenchmarkPageCacheEviction(b *testing.B) {
+	tree := testTree(20000)
+	cache := tree.UseCache(tree.Stats().Nodes / 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Get([]byte(fmt.Sprintf("key%06d", i*7919%20000)))
+	}
+	hits, misses := cache.Stats()
+	b.ReportMetric(float64(hits)/float64(hits+misses), "hits/op")
+}
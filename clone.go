@@ -0,0 +1,98 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// CloneTo writes a copy of the last committed tree into a new file at
+// path, e.g. for a backup. only the pages reachable from the root are
+// copied and they are packed at the start of the new file, which starts
+// with an empty free list. every page is checked against its checksum
+// while it's copied, and the checksums are recomputed for the new file.
+// the copy is held in memory until it's committed
+func (store *FileStore) CloneTo(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("clone target %s already exists", path)
+	}
+	clone, err := OpenFileSize(path, store.pageSize)
+	if err != nil {
+		return err
+	}
+
+	if store.root != 0 {
+		clone.root, err = store.cloneNode(clone, store.root)
+		clone.count = store.count
+	}
+	if err == nil {
+		err = clone.commit()
+	}
+	if err == nil {
+		return clone.Close()
+	}
+	clone.Close()
+	os.Remove(path)
+	os.Remove(path + ".wal")
+	return err
+}
+
+// read a committed page and verify its checksum
+func (store *FileStore) cloneRead(ptr uint64) ([]byte, error) {
+	if !(0 < ptr && ptr < store.page.flushed) {
+		return nil, fmt.Errorf("bad page pointer %d", ptr)
+	}
+	page := store.pageRead(ptr)
+	if binary.LittleEndian.Uint32(page[4:8]) != pageChecksum(page) {
+		return nil, fmt.Errorf("page %d: %w", ptr, ErrChecksum)
+	}
+	return bytes.Clone(page), nil
+}
+
+// copy a node and the pages below it, returning the page of the copy
+func (store *FileStore) cloneNode(clone *BTree, ptr uint64) (uint64, error) {
+	page, err := store.cloneRead(ptr)
+	if err != nil {
+		return 0, err
+	}
+	node := BNode(page)
+	if node.btype() != BNODE_NODE && node.btype() != BNODE_LEAF {
+		return 0, fmt.Errorf("page %d: bad node type %d", ptr, node.btype())
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kid := node.getPtr(i)
+		if node.btype() == BNODE_NODE {
+			kid, err = store.cloneNode(clone, kid)
+		} else if kid != 0 {
+			kid, err = store.cloneOverflow(clone, kid)
+		}
+		if err != nil {
+			return 0, err
+		}
+		node.setPtr(i, kid)
+	}
+	return clone.new(node), nil
+}
+
+// copy the overflow pages of a value, returning the first page of the copy
+func (store *FileStore) cloneOverflow(clone *BTree, ptr uint64) (uint64, error) {
+	var pages [][]byte
+	for ; ptr != 0; ptr = binary.LittleEndian.Uint64(pages[len(pages)-1][8:16]) {
+		page, err := store.cloneRead(ptr)
+		if err != nil {
+			return 0, err
+		}
+		if binary.LittleEndian.Uint16(page[0:2]) != BNODE_OVERFLOW {
+			return 0, fmt.Errorf("page %d: bad overflow page", ptr)
+		}
+		pages = append(pages, page)
+	}
+	// allocated backwards so each page can point to the next one
+	next := uint64(0)
+	for i := len(pages) - 1; i >= 0; i-- {
+		binary.LittleEndian.PutUint64(pages[i][8:16], next)
+		next = clone.new(pages[i])
+	}
+	return next, nil
+}
@@ -0,0 +1,78 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloneTo(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := OpenFile(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	tree.Insert([]byte("big"), bytes.Repeat([]byte("x"), 10000))
+	halfDeleted(tree)
+	kvs := treeKVs(tree)
+	store := tree.store.(*FileStore)
+
+	path := filepath.Join(dir, "clone")
+	if err := store.CloneTo(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CloneTo(path); err == nil {
+		t.Fatal("cloned over an existing file")
+	}
+
+	clone, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+	if !sameKVs(treeKVs(clone), kvs) || clone.Len() != tree.Len() {
+		t.Fatalf("%d keys", clone.Len())
+	}
+	if err := clone.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// the orphaned pages are dropped, so the clone is smaller
+	cloned := clone.store.(*FileStore)
+	if cloned.page.flushed >= store.page.flushed || cloned.free.tailSeq != cloned.free.headSeq {
+		t.Fatalf("%d pages, from %d", cloned.page.flushed, store.page.flushed)
+	}
+}
+
+func TestCloneToChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := OpenFile(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	tree.Insert([]byte("a"), []byte("old"))
+	// flip a byte of the root in the file, under the mapping
+	fp, err := os.OpenFile(filepath.Join(dir, "db"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(tree.root)*BTREE_PAGE_SIZE + HEADER
+	if _, err := fp.WriteAt([]byte{0xff}, offset); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	store := tree.store.(*FileStore)
+
+	path := filepath.Join(dir, "clone")
+	if err := store.CloneTo(path); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("CloneTo: %v", err)
+	}
+	// the partial clone is removed
+	if clone, err := OpenFileReadOnly(path); err == nil {
+		clone.Close()
+		t.Fatal("the clone was kept")
+	}
+}
@@ -0,0 +1,44 @@
+package btree
+
+// Compact rebuilds the tree with densely packed nodes, as if it was bulk
+// loaded with its KVs, then frees the pages of the old tree.
+// all the KVs are held in memory while the tree is rebuilt.
+// a page failing its checksum is returned before anything is changed
+func (tree *BTree) Compact() error {
+	if tree.root == 0 {
+		return nil
+	}
+
+	var kvs []KV
+	iter := tree.Iterate()
+	for iter.Next() {
+		kvs = append(kvs, iter.KV())
+	}
+	if err := iter.Err(); err != nil {
+		return err // the tree is left as it was
+	}
+	// the old pages are kept until the new tree is built from them
+	old := tree.root
+	tree.root = 0
+	tree.bulkLoad(kvs)
+	tree.freeTree(old)
+	return tree.commit()
+}
+
+// deallocate every page reachable from ptr
+func (tree *BTree) freeTree(ptr uint64) {
+	node := BNode(tree.get(ptr))
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kid := node.getPtr(i)
+		if kid == 0 {
+			continue
+		}
+		switch node.btype() {
+		case BNODE_NODE:
+			tree.freeTree(kid)
+		case BNODE_LEAF:
+			tree.overflowFree(kid)
+		}
+	}
+	tree.del(ptr)
+}
@@ -0,0 +1,86 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// insert 5000 keys one by one then delete every other one, in 1 commit
+func halfDeleted(tree *BTree) {
+	for i := 0; i < 5000; i++ {
+		tree.insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100), MODE_UPSERT)
+	}
+	for i := 0; i < 5000; i += 2 {
+		tree.delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	tree.commit()
+}
+
+func TestCompact(t *testing.T) {
+	tree := NewMemTree()
+	tree.Insert([]byte("big"), bytes.Repeat([]byte("x"), 10000))
+	halfDeleted(tree)
+	before, kvs := tree.Stats(), treeKVs(tree)
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after := tree.Stats()
+	if after.Nodes > before.Nodes*4/5 || after.Fill < 0.9 {
+		t.Fatalf("%d nodes filled at %.2f, from %d at %.2f", after.Nodes, after.Fill, before.Nodes, before.Fill)
+	}
+	if !sameKVs(treeKVs(tree), kvs) || tree.Len() != 2501 {
+		t.Fatalf("%d keys", tree.Len())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLeak(t, tree)
+	if err := NewMemTree().Compact(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	halfDeleted(tree)
+	kvs, nodes := treeKVs(tree), tree.Stats().Nodes
+	store := tree.store.(*FileStore)
+	free := func() int { return int(store.free.tailSeq - store.free.headSeq) }
+	before := free()
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// the old pages go to the free list, from which the next compaction
+	// takes its pages
+	if free()-before < nodes-tree.Stats().Nodes {
+		t.Fatalf("%d free pages, from %d", free(), before)
+	}
+	used := store.page.flushed
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if store.page.flushed != used {
+		t.Fatalf("%d pages used, from %d", store.page.flushed, used)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if !sameKVs(treeKVs(tree), kvs) {
+		t.Fatalf("%d keys", tree.Len())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package btree
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Codec compresses values, see BTree.Codec
+type Codec interface {
+	Compress(val []byte) []byte
+	Decompress(data []byte) ([]byte, error)
+}
+
+// with a codec, every value starts with a flag telling how it's stored,
+// values that don't get smaller are stored raw:
+// | flag | data |
+// |  1B  | ...  |
+const (
+	VAL_RAW        = 0
+	VAL_COMPRESSED = 1
+)
+
+// values shorter than this are not worth compressing
+const COMPRESS_MIN_SIZE = 64
+
+// encode a value for the leaf, before it's moved to overflow pages
+func (tree *BTree) valEncode(val []byte) []byte {
+	if tree.Codec == nil {
+		return val
+	}
+	if len(val) >= COMPRESS_MIN_SIZE {
+		if data := tree.Codec.Compress(val); len(data) < len(val) {
+			return append([]byte{VAL_COMPRESSED}, data...)
+		}
+	}
+	return append([]byte{VAL_RAW}, val...)
+}
+
+// decode a value stored by valEncode
+func (tree *BTree) valDecode(data []byte) []byte {
+	if tree.Codec == nil {
+		return data
+	}
+	if len(data) == 0 {
+		panic("value without the codec flag")
+	}
+	switch data[0] {
+	case VAL_RAW:
+		return data[1:]
+	case VAL_COMPRESSED:
+		val, err := tree.Codec.Decompress(data[1:])
+		if err != nil {
+			panic(fmt.Errorf("decompress value: %w", err))
+		}
+		return val
+	default:
+		panic(fmt.Sprintf("bad value flag %d", data[0]))
+	}
+}
+
+// FlateCodec compresses values with compress/flate
+type FlateCodec struct{}
+
+func (FlateCodec) Compress(val []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(val)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (FlateCodec) Decompress(data []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+}
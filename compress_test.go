@@ -0,0 +1,72 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestFlateCodec(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	noise := make([]byte, 200)
+	rng.Read(noise)
+	vals := map[string][]byte{}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		switch i % 4 {
+		case 0: // text
+			vals[key] = bytes.Repeat([]byte(key+" the quick brown fox "), 50)
+		case 1: // tiny
+			vals[key] = []byte{byte(i)}
+		case 2: // incompressible
+			vals[key] = noise
+		case 3: // too big for a page, moved to overflow pages
+			vals[key] = bytes.Repeat([]byte(key), 2000)
+		}
+	}
+
+	plain, compressed := NewMemTree(), NewMemTree()
+	compressed.Codec = FlateCodec{}
+	for _, tree := range []*BTree{plain, compressed} {
+		for key, val := range vals {
+			if err := tree.Insert([]byte(key), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	compressed.Insert([]byte("empty"), nil)
+	vals["empty"] = nil
+
+	for key, val := range vals {
+		got, ok := compressed.Get([]byte(key))
+		if !ok || !bytes.Equal(got, val) {
+			t.Fatalf("%s: %d bytes, want %d", key, len(got), len(val))
+		}
+	}
+	// the values that don't get smaller are kept raw behind the flag
+	compressed.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		for i := uint16(1); i < node.nkeys() && node.btype() == BNODE_LEAF; i++ {
+			key, data := node.getKey(i), node.getVal(i)
+			if node.getPtr(i) != 0 {
+				continue
+			}
+			want := byte(VAL_COMPRESSED)
+			if val := vals[string(key)]; len(val) < COMPRESS_MIN_SIZE || bytes.Equal(val, noise) {
+				want = VAL_RAW
+			}
+			if data[0] != want {
+				t.Fatalf("%s stored with the flag %d", key, data[0])
+			}
+		}
+		return true
+	})
+	if err := compressed.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, c := plain.store.(*MemStore), compressed.store.(*MemStore)
+	if len(c.pages) >= len(p.pages)/2 {
+		t.Fatalf("%d pages compressed, %d raw", len(c.pages), len(p.pages))
+	}
+}
@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"encoding/binary"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// the subtree key counts of internal nodes (BNODE_COUNTS):
+// the value of each KV is the number of leaf keys under its kid,
+// counting the dummy key, as a little-endian uint64.
+// a node with counts only has kids with counts, or leaves, so the counts
+// of a new node are always computed from its kids alone
+
+// the flags of a new internal node above node, which keeps the layout of
+// the internal nodes already in the tree, see SubtreeCounts
+func (tree *BTree) nodeFlags(node BNode) uint16 {
+	if len(node) > 0 && node.btype() == BNODE_NODE {
+		return node.flags()
+	}
+	if tree.SubtreeCounts {
+		return BNODE_COUNTS
+	}
+	return 0
+}
+
+// the number of leaf keys under a node, including the dummy key
+func nodeKeyCount(node BNode) uint64 {
+	if node.btype() == BNODE_LEAF {
+		return uint64(node.nkeys())
+	}
+	utils.Assert(node.flags()&BNODE_COUNTS != 0, "internal node without key counts")
+	count := uint64(0)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		count += binary.LittleEndian.Uint64(node.getVal(i))
+	}
+	return count
+}
+
+// the value of the KV of a kid in a parent with the given flags
+func kidCountVal(flags uint16, kid BNode) []byte {
+	if flags&BNODE_COUNTS == 0 {
+		return nil
+	}
+	return binary.LittleEndian.AppendUint64(nil, nodeKeyCount(kid))
+}
+
+// whether Count can use the counts, which are either in all the internal
+// nodes or in none of them
+func (tree *BTree) hasCounts() bool {
+	root := BNode(tree.get(tree.root))
+	return root.btype() == BNODE_LEAF || root.flags()&BNODE_COUNTS != 0
+}
+
+// the number of leaf keys <= key, including the dummy key, and whether key
+// itself is in the tree. the kids before the path are counted by their counts
+func (tree *BTree) countLE(key []byte) (int, bool) {
+	n := 0
+	node := BNode(tree.get(tree.root))
+	for node.btype() == BNODE_NODE {
+		idx := nodeLookupLE(tree, node, key)
+		for i := uint16(0); i < idx; i++ {
+			n += int(binary.LittleEndian.Uint64(node.getVal(i)))
+		}
+		node = tree.get(node.getPtr(idx))
+	}
+	idx := nodeLookupLE(tree, node, key)
+	found := len(key) > 0 && tree.compare(node.getKey(idx), key) == 0
+	return n + int(idx) + 1, found
+}
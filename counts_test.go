@@ -0,0 +1,81 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// a tree of n keys like testTree, with or without the subtree counts
+func countsTree(n int, counts bool) *BTree {
+	tree := NewMemTree()
+	tree.SubtreeCounts = counts
+	val := make([]byte, 100)
+	for i := 0; i < n; i++ {
+		tree.insert([]byte(fmt.Sprintf("key%06d", i)), val, MODE_UPSERT)
+	}
+	tree.commit()
+	return tree
+}
+
+func TestSubtreeCounts(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	counted, plain := countsTree(20000, true), countsTree(20000, false)
+	if root := BNode(counted.get(counted.root)); root.flags()&BNODE_COUNTS == 0 {
+		t.Fatal("the root has no counts")
+	}
+	key := func() []byte { return []byte(fmt.Sprintf("key%06d", rng.Intn(25000))) }
+
+	// the counts follow every kind of update
+	for round := 0; round < 5; round++ {
+		var kvs []KV
+		for i := 0; i < 200; i++ {
+			kvs = append(kvs, KV{Key: key(), Val: make([]byte, 100)})
+		}
+		start, end := key(), key()
+		del := key()
+		for _, tree := range []*BTree{counted, plain} {
+			for _, kv := range kvs[:100] {
+				tree.Delete(kv.Key)
+			}
+			tree.InsertBatch(kvs)
+			tree.DeleteRange(start, end)
+			tree.Delete(del)
+		}
+		if err := counted.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			start, end := key(), key()
+			if n, want := counted.Count(start, end), plain.Count(start, end); n != want {
+				t.Fatalf("%s-%s: %d keys, want %d", start, end, n, want)
+			}
+		}
+	}
+
+	// a range over the whole tree is counted by 2 descents
+	height := counted.Stats().Height
+	reads := countReads(counted)
+	if n := counted.Count([]byte("a"), []byte("z")); n != counted.Len() {
+		t.Fatalf("%d keys, want %d", n, counted.Len())
+	}
+	if *reads > 2*height+1 {
+		t.Fatalf("%d reads for a height of %d", *reads, height)
+	}
+}
+
+// counting most of a tree, by its subtree counts or by visiting the keys
+func BenchmarkCount(b *testing.B) {
+	for _, counts := range []bool{false, true} {
+		b.Run(fmt.Sprintf("counts-%v", counts), func(b *testing.B) {
+			tree := countsTree(100000, counts)
+			start, end := []byte("key001000"), []byte("key098999")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if n := tree.Count(start, end); n != 98000 {
+					b.Fatalf("%d keys", n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package btree
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+// ImportCSV inserts the keyCol and valCol columns of each CSV row as a KV,
+// skipping the first row if header is set. an empty tree is bulk loaded,
+// and the last row wins when a key appears more than once
+func (tree *BTree) ImportCSV(r io.Reader, keyCol int, valCol int, header bool) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // checked below for the used columns only
+	var kvs []KV
+	for nrow := 1; ; nrow++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read CSV: %w", err)
+		}
+		if nrow == 1 && header {
+			continue
+		}
+		if keyCol >= len(row) || valCol >= len(row) {
+			return fmt.Errorf("CSV row %d: only %d columns", nrow, len(row))
+		}
+		kv := KV{Key: []byte(row[keyCol]), Val: []byte(row[valCol])}
+		if err := checkKV(kv.Key, kv.Val); err != nil {
+			return fmt.Errorf("CSV row %d: %w", nrow, err)
+		}
+		kvs = append(kvs, kv)
+	}
+
+	if tree.root != 0 {
+		return tree.InsertBatch(kvs)
+	}
+	return tree.BulkLoad(sortKVs(tree, kvs))
+}
@@ -0,0 +1,48 @@
+package btree
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImportCSV(t *testing.T) {
+	const data = `id,name,city
+3,"Smith, John","Paris, France"
+1,Alice,Berlin
+2,"Bob ""the builder""",Rome
+1,Alice,Madrid
+`
+	tree := NewMemTree()
+	if err := tree.ImportCSV(strings.NewReader(data), 1, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"Smith, John":       "Paris, France",
+		"Alice":             "Madrid", // the last row wins
+		`Bob "the builder"`: "Rome",
+	} {
+		if val, ok := tree.Get([]byte(key)); !ok || string(val) != want {
+			t.Fatalf("%s: %q %v", key, val, ok)
+		}
+	}
+	if tree.Len() != 3 || tree.Exists([]byte("name")) {
+		t.Fatalf("%d keys", tree.Len())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// with the header as a row, into a tree with keys
+	if err := tree.ImportCSV(strings.NewReader(data), 0, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := tree.Get([]byte("id")); string(val) != "name" || tree.Len() != 7 {
+		t.Fatalf("%q, %d keys", val, tree.Len())
+	}
+
+	for _, bad := range []string{"a,b\nc\n", "a,\"b\n"} {
+		if err := NewMemTree().ImportCSV(strings.NewReader(bad), 0, 1, false); err == nil {
+			t.Fatalf("imported %q", bad)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package btree
+
+import (
+	"encoding/binary"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// DB holds multiple named trees in one file. the file is backed by a
+// catalog tree mapping the name of each tree to its root and key count:
+// | root | nkeys |
+// |  8B  |  8B   |
+// every update of a named tree is committed by updating its catalog
+// entry, so updates to several trees can be committed at once, see Update
+type DB struct {
+	catalog *BTree
+	trees   map[string]*BTree
+}
+
+// OpenDB opens or creates a file of named trees at path
+func OpenDB(path string) (*DB, error) {
+	catalog, err := OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{catalog: catalog, trees: map[string]*BTree{}}, nil
+}
+
+// Close closes the file, the trees can't be used afterwards
+func (db *DB) Close() error {
+	return db.catalog.Close()
+}
+
+// Tree returns the tree of the given name, which is empty if it doesn't
+// exist yet. the same tree is returned for the same name
+func (db *DB) Tree(name string) *BTree {
+	utils.Assert(name != "", "empty tree name")
+	if tree, ok := db.trees[name]; ok {
+		return tree
+	}
+
+	file := db.catalog.store.(*FileStore)
+	tree := newTree(&dbStore{FileStore: file, db: db, name: name})
+	db.loadEntry(name, tree)
+	db.trees[name] = tree
+	return tree
+}
+
+// read the root of a tree from its catalog entry
+func (db *DB) loadEntry(name string, tree *BTree) {
+	tree.root, tree.count = 0, 0
+	if entry, ok := db.catalog.Get([]byte(name)); ok {
+		tree.root = binary.LittleEndian.Uint64(entry[0:])
+		tree.count = int(binary.LittleEndian.Uint64(entry[8:]))
+	}
+}
+
+// write the root of a tree into its catalog entry, without committing it
+func (db *DB) putEntry(name string, tree *BTree) {
+	entry := make([]byte, 16)
+	binary.LittleEndian.PutUint64(entry[0:], tree.root)
+	binary.LittleEndian.PutUint64(entry[8:], uint64(tree.count))
+	db.catalog.insert([]byte(name), entry, MODE_UPSERT)
+}
+
+// commit the catalog after the entries of the trees were updated,
+// reverting the trees to their last committed roots on failure
+func (db *DB) commit(names ...string) error {
+	err := db.catalog.commit()
+	for _, name := range names {
+		if err != nil {
+			db.loadEntry(name, db.trees[name])
+		}
+		db.trees[name].snapshotCommitted(err == nil)
+	}
+	return err
+}
+
+// dbStore serves the pages of a named tree from the file of the DB
+type dbStore struct {
+	*FileStore
+	db   *DB
+	name string
+}
+
+func (store *dbStore) Commit(tree *BTree) error {
+	store.db.putEntry(store.name, tree)
+	return store.db.commit(store.name)
+}
+
+// Close does nothing, the file is closed by DB.Close
+func (store *dbStore) Close() error {
+	return nil
+}
+
+// Txn is a transaction over several trees of a DB, see Update
+type Txn struct {
+	db  *DB
+	txs map[string]*Tx
+}
+
+// Tree returns the tree of the given name as seen by the transaction.
+// its updates are applied when the transaction commits, the tree returned
+// by DB.Tree must not be updated while the transaction is running
+func (txn *Txn) Tree(name string) *BTree {
+	tx, ok := txn.txs[name]
+	if !ok {
+		tx = txn.db.Tree(name).Begin()
+		txn.txs[name] = tx
+	}
+	return tx.pending
+}
+
+// Update runs fn in a transaction and commits the updates it made to the
+// trees of the DB all at once. if fn returns an error or the commit fails,
+// none of the updates are applied
+func (db *DB) Update(fn func(txn *Txn) error) error {
+	txn := &Txn{db: db, txs: map[string]*Tx{}}
+	if err := fn(txn); err != nil {
+		for _, tx := range txn.txs {
+			tx.Rollback()
+		}
+		return err
+	}
+
+	var names []string
+	for name, tx := range txn.txs {
+		tx.done = true
+		tx.apply()
+		db.putEntry(name, tx.tree)
+		names = append(names, name)
+	}
+	return db.commit(names...)
+}
@@ -0,0 +1,79 @@
+package btree
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// the value of key in a tree, "" if it's missing
+func dbGet(tree *BTree, key string) string {
+	val, _ := tree.Get([]byte(key))
+	return string(val)
+}
+
+func TestDBUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a table and its index
+	err = db.Update(func(txn *Txn) error {
+		if err := txn.Tree("users").Insert([]byte("1"), []byte("bob")); err != nil {
+			return err
+		}
+		return txn.Tree("names").Insert([]byte("bob"), []byte("1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, names := db.Tree("users"), db.Tree("names")
+	if dbGet(users, "1") != "bob" || dbGet(names, "bob") != "1" || dbGet(names, "1") != "" {
+		t.Fatal("the updates were not applied")
+	}
+
+	// a failing transaction applies none of its updates
+	fail := errors.New("fail")
+	err = db.Update(func(txn *Txn) error {
+		txn.Tree("users").Insert([]byte("1"), []byte("alice"))
+		txn.Tree("names").Delete([]byte("bob"))
+		txn.Tree("names").Insert([]byte("alice"), []byte("1"))
+		return fail
+	})
+	if err != fail {
+		t.Fatalf("Update: %v", err)
+	}
+	if dbGet(users, "1") != "bob" || dbGet(names, "bob") != "1" || names.Len() != 1 {
+		t.Fatal("the updates of the failed transaction were applied")
+	}
+
+	// the trees are updated on their own too
+	if err := users.Insert([]byte("2"), []byte("carol")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, names = db.Tree("users"), db.Tree("names")
+	if dbGet(users, "1") != "bob" || dbGet(users, "2") != "carol" || users.Len() != 2 {
+		t.Fatalf("users: %d keys", users.Len())
+	}
+	if dbGet(names, "bob") != "1" || names.Len() != 1 {
+		t.Fatalf("names: %d keys", names.Len())
+	}
+	if db.Tree("other").Len() != 0 {
+		t.Fatal("a new tree has keys")
+	}
+	for _, tree := range []*BTree{users, names} {
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build debug
+
+package btree
+
+import (
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// debug builds also check the default page size against the size limits
+// when the package is loaded, instead of only when a file is opened
+func init() {
+	utils.Assert(checkPageSize(BTREE_PAGE_SIZE) == nil, "Node is greater than defined page size")
+}
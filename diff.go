@@ -0,0 +1,49 @@
+package btree
+
+import (
+	"bytes"
+)
+
+// the ways a key can differ between 2 trees, see Diff
+type DiffKind uint8
+
+const (
+	DIFF_ONLY_A  DiffKind = 1 // the key is only in a, bVal is nil
+	DIFF_ONLY_B  DiffKind = 2 // the key is only in b, aVal is nil
+	DIFF_CHANGED DiffKind = 3 // the key is in both trees with different values
+)
+
+// Diff calls fn in key order with each key that differs between a and b.
+// both trees are walked together, so it's linear in the number of KVs.
+// the trees must have the same order, see Cmp. the slices passed to fn
+// are only valid until the trees are modified. a page failing its checksum
+// ends the walk, with the error returned by Close of its tree
+func Diff(a *BTree, b *BTree, fn func(kind DiffKind, key, aVal, bVal []byte)) {
+	ia, ib := a.Iterate(), b.Iterate()
+	moreA, moreB := ia.Next(), ib.Next()
+	for (moreA || moreB) && ia.Err() == nil && ib.Err() == nil {
+		var cmp int
+		switch {
+		case !moreB:
+			cmp = -1
+		case !moreA:
+			cmp = +1
+		default:
+			cmp = a.compare(ia.Key(), ib.Key())
+		}
+
+		switch {
+		case cmp < 0:
+			fn(DIFF_ONLY_A, ia.Key(), ia.Val(), nil)
+			moreA = ia.Next()
+		case cmp > 0:
+			fn(DIFF_ONLY_B, ib.Key(), nil, ib.Val())
+			moreB = ib.Next()
+		default:
+			if aVal, bVal := ia.Val(), ib.Val(); !bytes.Equal(aVal, bVal) {
+				fn(DIFF_CHANGED, ia.Key(), aVal, bVal)
+			}
+			moreA, moreB = ia.Next(), ib.Next()
+		}
+	}
+}
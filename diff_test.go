@@ -0,0 +1,56 @@
+package btree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// the differences reported by Diff, one line each
+func diffLines(a *BTree, b *BTree) []string {
+	var lines []string
+	Diff(a, b, func(kind DiffKind, key, aVal, bVal []byte) {
+		lines = append(lines, fmt.Sprintf("%d %s %q %q", kind, key, aVal, bVal))
+	})
+	return lines
+}
+
+func TestDiff(t *testing.T) {
+	a := mergeTree(0, 3000, "v")
+	b := mergeTree(0, 3000, "v")
+	if got := diffLines(a, b); len(got) != 0 {
+		t.Fatalf("identical trees: %v", got)
+	}
+
+	// known changes to b: added keys, including past the end of a, deleted
+	// keys, including the first one, and modified values
+	b.Insert([]byte("key0100x"), []byte("added"))
+	b.Insert([]byte("zzz"), []byte("added"))
+	b.Delete([]byte("key0000"))
+	b.Delete([]byte("key1500"))
+	b.Insert([]byte("key2000"), []byte("changed"))
+	b.Insert([]byte("key2999"), []byte(""))
+	want := []string{
+		`1 key0000 "v0000" ""`,
+		`2 key0100x "" "added"`,
+		`1 key1500 "v1500" ""`,
+		`3 key2000 "v2000" "changed"`,
+		`3 key2999 "v2999" ""`,
+		`2 zzz "" "added"`,
+	}
+	if got := diffLines(a, b); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("diff:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// swapped, the kinds are too
+	reversed := diffLines(b, a)
+	if len(reversed) != len(want) || !strings.HasPrefix(reversed[0], "2 key0000 ") || !strings.HasPrefix(reversed[1], "1 key0100x ") {
+		t.Fatalf("reversed: %v", reversed)
+	}
+	if got := diffLines(a, NewMemTree()); len(got) != 3000 || got[0] != `1 key0000 "v0000" ""` {
+		t.Fatalf("against an empty tree: %d differences", len(got))
+	}
+	if got := diffLines(NewMemTree(), NewMemTree()); len(got) != 0 {
+		t.Fatalf("empty trees: %v", got)
+	}
+}
@@ -0,0 +1,62 @@
+package btree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DumpDot writes the tree as a Graphviz DOT graph for debugging.
+// every node is a record of its keys, internal nodes are shaded
+// and also show the pointers linking them to their kids.
+// render it with e.g. `dot -Tsvg`
+func (tree *BTree) DumpDot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph btree {")
+	fmt.Fprintln(bw, "\tnode [shape=record];")
+	tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		dumpDotNode(bw, ptr, node)
+		return true
+	})
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// the record of a node and the edges to its kids
+func dumpDotNode(w io.Writer, ptr uint64, node BNode) {
+	fields := make([]string, node.nkeys())
+	for i := range fields {
+		label := dotEscape(strconv.Quote(string(node.getKey(uint16(i)))))
+		if node.btype() == BNODE_NODE {
+			label += fmt.Sprintf(" (page %d)", node.getPtr(uint16(i)))
+		}
+		fields[i] = fmt.Sprintf("<f%d> %s", i, label)
+	}
+
+	style := ""
+	if node.btype() == BNODE_NODE {
+		style = ", style=filled, fillcolor=lightgrey"
+	}
+	fmt.Fprintf(w, "\tn%d [label=\"%s\"%s];\n", ptr, strings.Join(fields, " | "), style)
+
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid := node.getPtr(i)
+			fmt.Fprintf(w, "\tn%d:f%d -> n%d;\n", ptr, i, kid)
+		}
+	}
+}
+
+// escape the characters that have a meaning in record labels
+func dotEscape(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`{}|<>"\`, c) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
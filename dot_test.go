@@ -0,0 +1,43 @@
+package btree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDumpDot(t *testing.T) {
+	tree := testLeafTree(3, 3, 3)
+	root := BNode(tree.get(tree.root))
+	var sb strings.Builder
+	if err := tree.DumpDot(&sb); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+
+	for _, want := range []string{
+		"digraph btree {",
+		// the internal node is shaded and shows its pointers
+		fmt.Sprintf(`n%d [label="<f0> \"\" (page %d) | <f1> \"key002\" (page %d) | <f2> \"key005\" (page %d)", style=filled`,
+			tree.root, root.getPtr(0), root.getPtr(1), root.getPtr(2)),
+		fmt.Sprintf("n%d:f2 -> n%d;", tree.root, root.getPtr(2)),
+		// the leaves only show their keys
+		fmt.Sprintf(`n%d [label="<f0> \"key002\" | <f1> \"key003\" | <f2> \"key004\""];`, root.getPtr(1)),
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("no %s in\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "->"); n != 3 {
+		t.Fatalf("%d edges", n)
+	}
+
+	// the characters of the record syntax are escaped
+	tree = NewMemTree()
+	tree.Insert([]byte("a|<b>"), nil)
+	sb.Reset()
+	tree.DumpDot(&sb)
+	if want := `\"a\|\<b\>\"`; !strings.Contains(sb.String(), want) {
+		t.Fatalf("no %s in\n%s", want, sb.String())
+	}
+}
@@ -0,0 +1,108 @@
+package btree
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// the logical export of a tree, independent of the page layout:
+// | sig | klen | vlen | key | val | ... |
+// | 16B |  4B  |  4B  | ... | ... |
+const EXPORT_SIG = "go-database.kv1\x00"
+
+// Export writes every KV of the tree to w in key order
+func (tree *BTree) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(EXPORT_SIG); err != nil {
+		return err
+	}
+	iter := tree.Iterate()
+	for iter.Next() {
+		var lens [8]byte
+		binary.LittleEndian.PutUint32(lens[0:], uint32(len(iter.Key())))
+		binary.LittleEndian.PutUint32(lens[4:], uint32(len(iter.Val())))
+		bw.Write(lens[:])
+		bw.Write(iter.Key())
+		if _, err := bw.Write(iter.Val()); err != nil {
+			return err
+		}
+	}
+	if iter.Err() != nil {
+		return iter.Err()
+	}
+	return bw.Flush()
+}
+
+// ContentHash returns the SHA-256 of the KVs of the tree in key order, each
+// prefixed with the lengths like in Export. it only depends on the KVs, so
+// trees with the same KVs hash the same whatever their page layout, codec
+// or history, which is a cheap way to compare replicas. it's nil if a page
+// fails its checksum, the error is then returned by Close
+func (tree *BTree) ContentHash() []byte {
+	defer tree.recoverChecksum()
+	h := sha256.New()
+	if tree.root == 0 {
+		return h.Sum(nil)
+	}
+	tree.forEach(tree.get(tree.root), true, func(key []byte, val []byte) bool {
+		var lens [8]byte
+		binary.LittleEndian.PutUint32(lens[0:], uint32(len(key)))
+		binary.LittleEndian.PutUint32(lens[4:], uint32(len(val)))
+		h.Write(lens[:])
+		h.Write(key)
+		h.Write(val)
+		return true
+	})
+	return h.Sum(nil)
+}
+
+// Import reads the KVs written by Export into the tree.
+// an empty tree is bulk loaded, otherwise the KVs are inserted as a batch
+func Import(r io.Reader, tree *BTree) error {
+	br := bufio.NewReader(r)
+	sig := make([]byte, len(EXPORT_SIG))
+	if _, err := io.ReadFull(br, sig); err != nil {
+		return fmt.Errorf("read export header: %w", err)
+	}
+	if string(sig) != EXPORT_SIG {
+		return errors.New("bad export signature")
+	}
+
+	var kvs []KV
+	for {
+		var lens [8]byte
+		if _, err := io.ReadFull(br, lens[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read export record: %w", err)
+		}
+		klen := binary.LittleEndian.Uint32(lens[0:])
+		vlen := binary.LittleEndian.Uint32(lens[4:])
+		if klen > BTREE_MAX_KEY_SIZE {
+			return fmt.Errorf("key of %d bytes is too large, the limit is %d bytes", klen, BTREE_MAX_KEY_SIZE)
+		}
+		key := make([]byte, klen)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return fmt.Errorf("read export record: %w", err)
+		}
+		// values have no size limit, so the value is read as it comes
+		// rather than allocated from a length that may be corrupt
+		val, err := io.ReadAll(io.LimitReader(br, int64(vlen)))
+		if err != nil {
+			return fmt.Errorf("read export record: %w", err)
+		}
+		if len(val) != int(vlen) {
+			return fmt.Errorf("read export record: %w", io.ErrUnexpectedEOF)
+		}
+		kvs = append(kvs, KV{Key: key, Val: val})
+	}
+
+	if tree.root == 0 {
+		return tree.BulkLoad(kvs)
+	}
+	return tree.InsertBatch(kvs)
+}
@@ -0,0 +1,137 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// the KVs of a tree in key order
+func treeKVs(tree *BTree) []KV {
+	var kvs []KV
+	for iter := tree.Iterate(); iter.Next(); {
+		kvs = append(kvs, KV{Key: bytes.Clone(iter.Key()), Val: bytes.Clone(iter.Val())})
+	}
+	return kvs
+}
+
+func sameKVs(a []KV, b []KV) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Key, b[i].Key) || !bytes.Equal(a[i].Val, b[i].Val) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestExportImport(t *testing.T) {
+	tree := NewMemTree()
+	for i := 0; i < 3000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte{byte(i), 0, byte(i >> 8)})
+	}
+	tree.Insert([]byte("big"), bytes.Repeat([]byte("x"), 20000))
+	tree.Insert([]byte("empty"), nil)
+
+	var buf bytes.Buffer
+	if err := tree.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// into an empty tree with another page size
+	imported, err := NewMemTreeSize(8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Import(bytes.NewReader(data), imported); err != nil {
+		t.Fatal(err)
+	}
+	if !sameKVs(treeKVs(imported), treeKVs(tree)) || imported.Len() != 3002 {
+		t.Fatalf("%d KVs imported", imported.Len())
+	}
+
+	// into a tree with keys of its own
+	other := NewMemTree()
+	other.Insert([]byte("key0000"), []byte("replaced"))
+	other.Insert([]byte("zzz"), []byte("kept"))
+	if err := Import(bytes.NewReader(data), other); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := other.Get([]byte("key0000")); !bytes.Equal(val, []byte{0, 0, 0}) || !other.Exists([]byte("zzz")) || other.Len() != 3003 {
+		t.Fatalf("%q, %d keys", val, other.Len())
+	}
+
+	// a corrupt length of 4GB is not allocated up front
+	huge := append([]byte(EXPORT_SIG), 3, 0, 0, 0, 0xff, 0xff, 0xff, 0xff)
+	huge = append(huge, "keyval"...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := Import(bytes.NewReader(huge), NewMemTree()); err == nil {
+		t.Fatal("imported a truncated value")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("%d bytes allocated", n)
+	}
+
+	for _, bad := range [][]byte{nil, []byte("not an export"), data[:len(data)-1]} {
+		if err := Import(bytes.NewReader(bad), NewMemTree()); err == nil {
+			t.Fatalf("imported %q", bad[:min(len(bad), 20)])
+		}
+	}
+	if err := Import(strings.NewReader(EXPORT_SIG), NewMemTree()); err != nil {
+		t.Fatalf("empty export: %v", err)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	kvs := sortedKVs(5000)
+	kvs = append(kvs, KV{Key: []byte("zbig"), Val: bytes.Repeat([]byte("x"), 10000)})
+
+	// the same KVs in trees of different layouts and histories
+	bulk := NewMemTree()
+	bulk.BulkLoad(kvs)
+	reversed := NewMemTree()
+	reversed.PrefixCompression = true
+	reversed.SubtreeCounts = true
+	for i := len(kvs) - 1; i >= 0; i-- {
+		reversed.Insert(kvs[i].Key, kvs[i].Val)
+	}
+	big, _ := NewMemTreeSize(8192)
+	big.Codec = FlateCodec{}
+	for i := 0; i < 7000; i++ {
+		big.Insert([]byte(fmt.Sprintf("key%08d", i)), []byte("old"))
+	}
+	big.DeleteRange([]byte("key00005000"), []byte("key99999999"))
+	big.InsertBatch(kvs)
+	if bulk.Stats() == reversed.Stats() {
+		t.Fatal("the trees have the same layout")
+	}
+	hash := bulk.ContentHash()
+	for _, tree := range []*BTree{reversed, big} {
+		if !bytes.Equal(tree.ContentHash(), hash) {
+			t.Fatalf("%+v: another hash", tree.Stats())
+		}
+	}
+
+	// any change to the KVs changes it, also moving a byte from the key
+	// to the value
+	big.Insert([]byte("key00000042"), []byte("new"))
+	if bytes.Equal(big.ContentHash(), hash) {
+		t.Fatal("the same hash after an update")
+	}
+	a, b := NewMemTree(), NewMemTree()
+	a.Insert([]byte("ab"), []byte("c"))
+	b.Insert([]byte("a"), []byte("bc"))
+	if bytes.Equal(a.ContentHash(), b.ContentHash()) {
+		t.Fatal("the length prefixes are not hashed")
+	}
+	if len(NewMemTree().ContentHash()) != 32 {
+		t.Fatal("no hash for an empty tree")
+	}
+}
@@ -0,0 +1,584 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// the initial size of the address space mapped for a file,
+// it's doubled whenever the file outgrows it
+const MMAP_INIT_SIZE = 64 << 20
+
+// FileStore serves pages from a memory-mapped file.
+// pages are read through the mapping, while new pages are buffered in
+// memory until the update is committed and then written into the file.
+// tree pages are never modified in place, freed pages go onto a free list
+// and are only reused after the update that freed them has been committed.
+type FileStore struct {
+	path     string
+	fp       *os.File
+	wal      *os.File // the write-ahead log, see walWrite
+	pageSize int
+	root     uint64 // the root of the last committed update
+	count    int    // the key count of the last committed update
+	err      error  // the first error committing an update
+	extent   int    // the minimum number of pages the file grows by, see SetExtent
+	readOnly bool   // see OpenFileReadOnly
+	free     FreeList
+	// the free list of the last committed update
+	committed FreeList
+	mmap      struct {
+		total  int      // mmap size, can be larger than the file size
+		chunks [][]byte // multiple mmaps, can be non-continuous
+	}
+	page struct {
+		flushed   uint64            // database size in number of pages, its high-water mark
+		allocated uint64            // file size in number of pages, the pages past flushed are unused
+		temp      [][]byte          // newly allocated pages appended to the file
+		updates   map[uint64][]byte // reused pages to be overwritten
+	}
+}
+
+// OpenFile opens or creates a tree backed by the file at path.
+// an existing file is opened with the page size it was created with,
+// a new one gets the default page size
+func OpenFile(path string) (*BTree, error) {
+	pageSize, err := filePageSize(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPageSize(pageSize); err != nil {
+		return nil, fmt.Errorf("the file is not supported by this build: %w", err)
+	}
+	return OpenFileSize(path, pageSize)
+}
+
+// read the page size from the meta page of a file, BTREE_PAGE_SIZE if the
+// file is new. the start of the meta page never changes once it's written,
+// so it's not torn by a crash. if it's damaged anyway, the default is
+// tried, with which the meta page may still be recovered from the WAL
+func filePageSize(path string) (int, error) {
+	fp, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return BTREE_PAGE_SIZE, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("open file: %w", err)
+	}
+	defer fp.Close()
+
+	data := make([]byte, 24)
+	if n, err := io.ReadFull(fp, data); n == 0 && err == io.EOF {
+		return BTREE_PAGE_SIZE, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("read meta page: %w", err)
+	}
+	if string(data[:16]) != DB_SIG {
+		return BTREE_PAGE_SIZE, nil
+	}
+	return int(binary.LittleEndian.Uint64(data[16:])), nil
+}
+
+// OpenFileSize is OpenFile with a custom page size,
+// an existing file must have been created with the same size
+func OpenFileSize(path string, pageSize int) (*BTree, error) {
+	if err := checkPageSize(pageSize); err != nil {
+		return nil, err
+	}
+	store, err := openFileStore(path, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	tree := newTree(store)
+	tree.root, tree.count = store.root, store.count
+	return tree, nil
+}
+
+// OpenFileReadOnly opens an existing file without ever writing into it,
+// e.g. to serve a static dataset from multiple processes. updates to the
+// tree are only made in memory and fail on commit with ErrReadOnly, which
+// reverts the tree and is returned by Close. a file left with an
+// interrupted commit in its WAL must be opened by OpenFile first to recover it
+func OpenFileReadOnly(path string) (*BTree, error) {
+	pageSize, err := filePageSize(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPageSize(pageSize); err != nil {
+		return nil, fmt.Errorf("the file is not supported by this build: %w", err)
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+
+	store := &FileStore{path: path, fp: fp, pageSize: pageSize, readOnly: true}
+	if err := store.setup(); err != nil {
+		return nil, err
+	}
+	tree := newTree(store)
+	tree.root, tree.count = store.root, store.count
+	return tree, nil
+}
+
+func openFileStore(path string, pageSize int) (*FileStore, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	wal, err := os.OpenFile(path+".wal", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("open WAL: %w", err)
+	}
+
+	store := &FileStore{path: path, fp: fp, wal: wal, pageSize: pageSize}
+	if err := store.setup(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// set up the store for its open files, releasing them on failure
+func (store *FileStore) setup() error {
+	store.page.updates = map[uint64][]byte{}
+	store.free.get = store.Get
+	store.free.new = store.pageAppend
+	store.free.set = store.pageWrite
+	store.free.pageSize = store.pageSize
+	if err := store.init(); err != nil {
+		store.release()
+		return err
+	}
+	return nil
+}
+
+// map the file and find out how many pages it holds
+func (store *FileStore) init() error {
+	if err := store.recover(); err != nil {
+		return err
+	}
+	fi, err := store.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	size := int(fi.Size())
+	if size%store.pageSize != 0 {
+		return errors.New("file size is not a multiple of the page size")
+	}
+	if size == 0 && store.readOnly {
+		return errors.New("the file is empty")
+	}
+
+	total := MMAP_INIT_SIZE
+	for total < size {
+		total *= 2
+	}
+	chunk, err := syscall.Mmap(int(store.fp.Fd()), 0, total, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	store.mmap.total = total
+	store.mmap.chunks = [][]byte{chunk}
+
+	if size == 0 {
+		// page 0 is reserved for the meta page
+		// page 1 is the first node of the free list
+		if _, err := store.fp.WriteAt(make([]byte, store.pageSize), 0); err != nil {
+			return fmt.Errorf("write meta page: %w", err)
+		}
+		head := newLNode(store.pageSize)
+		setPageChecksum(head)
+		if _, err := store.fp.WriteAt(head, int64(store.pageSize)); err != nil {
+			return fmt.Errorf("write free list: %w", err)
+		}
+		store.page.flushed, store.page.allocated = 2, 2
+		store.free.headPage, store.free.tailPage = 1, 1
+		if err := saveMeta(store, 0, 0); err != nil {
+			return err
+		}
+	} else if err := loadMeta(store, store.pageRead(0)); err != nil {
+		return err
+	} else {
+		store.page.allocated = uint64(size / store.pageSize)
+	}
+
+	store.free.setMaxSeq()
+	store.committed = store.free
+	return nil
+}
+
+// the meta page:
+// | sig | page size | root ptr | page used | free list head | free list tail | nkeys |
+// | 16B |    8B     |    8B    |     8B    |  8B ptr + 8B seq | 8B ptr + 8B seq |  8B   |
+const DB_SIG = "go-database.v1\x00\x00"
+
+// read the meta page and validate it against this build
+func loadMeta(store *FileStore, data []byte) error {
+	if string(data[:16]) != DB_SIG {
+		return errors.New("bad signature")
+	}
+	pageSize := binary.LittleEndian.Uint64(data[16:])
+	if pageSize != uint64(store.pageSize) {
+		return fmt.Errorf("page size mismatch: file %d, expected %d", pageSize, store.pageSize)
+	}
+	root := binary.LittleEndian.Uint64(data[24:])
+	used := binary.LittleEndian.Uint64(data[32:])
+	fl := &store.free
+	fl.headPage = binary.LittleEndian.Uint64(data[40:])
+	fl.headSeq = binary.LittleEndian.Uint64(data[48:])
+	fl.tailPage = binary.LittleEndian.Uint64(data[56:])
+	fl.tailSeq = binary.LittleEndian.Uint64(data[64:])
+	count := binary.LittleEndian.Uint64(data[72:])
+	npages := uint64(store.mmap.total / store.pageSize)
+	if !(2 <= used && used <= npages) || !(root < used) {
+		return errors.New("bad meta page")
+	}
+	if !(0 < fl.headPage && fl.headPage < used && 0 < fl.tailPage && fl.tailPage < used) {
+		return errors.New("bad free list in the meta page")
+	}
+
+	store.root, store.count = root, int(count)
+	store.page.flushed = used
+	return nil
+}
+
+// the content of the meta page for a root, its key count and the number of used pages
+func metaData(store *FileStore, root uint64, count int, used uint64) []byte {
+	data := make([]byte, 80)
+	copy(data[:16], DB_SIG)
+	binary.LittleEndian.PutUint64(data[16:], uint64(store.pageSize))
+	binary.LittleEndian.PutUint64(data[24:], root)
+	binary.LittleEndian.PutUint64(data[32:], used)
+	binary.LittleEndian.PutUint64(data[40:], store.free.headPage)
+	binary.LittleEndian.PutUint64(data[48:], store.free.headSeq)
+	binary.LittleEndian.PutUint64(data[56:], store.free.tailPage)
+	binary.LittleEndian.PutUint64(data[64:], store.free.tailSeq)
+	binary.LittleEndian.PutUint64(data[72:], uint64(count))
+	return data
+}
+
+// update the meta page with a new root, the pages must be flushed first
+// so the meta page never refers to pages that are not on disk
+func saveMeta(store *FileStore, root uint64, count int) error {
+	data := metaData(store, root, count, store.page.flushed)
+	// NOTE: a torn write of the meta page is repaired from the WAL
+	if _, err := store.fp.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	if err := store.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// extend the mapping by doubling the address space
+func (store *FileStore) extendMmap(npages int) error {
+	if store.mmap.total >= npages*store.pageSize {
+		return nil
+	}
+
+	chunk, err := syscall.Mmap(
+		int(store.fp.Fd()), int64(store.mmap.total), store.mmap.total,
+		syscall.PROT_READ, syscall.MAP_SHARED,
+	)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	store.mmap.total += store.mmap.total
+	store.mmap.chunks = append(store.mmap.chunks, chunk)
+	return store.extendMmap(npages)
+}
+
+// SetExtent makes the file behind the tree grow by at least npages pages at
+// a time instead of by the pages of each commit, which saves growing the
+// file over and over during a bulk load. 0 turns it off
+func (tree *BTree) SetExtent(npages int) {
+	switch store := tree.store.(type) {
+	case *FileStore:
+		store.extent = npages
+	case *dbStore:
+		store.extent = npages
+	default:
+		utils.Assert(false, "the tree is not backed by a file")
+	}
+}
+
+// grow the file ahead of the pages written into it
+func (store *FileStore) extendFile(npages int) error {
+	if uint64(npages) <= store.page.allocated || store.extent <= 0 {
+		return nil
+	}
+	npages = max(npages, int(store.page.allocated)+store.extent)
+	if err := store.fp.Truncate(int64(npages) * int64(store.pageSize)); err != nil {
+		return fmt.Errorf("grow file: %w", err)
+	}
+	store.page.allocated = uint64(npages)
+	return nil
+}
+
+// read a flushed page through the mapping
+func (store *FileStore) pageRead(ptr uint64) []byte {
+	pageSize := uint64(store.pageSize)
+	start := uint64(0)
+	for _, chunk := range store.mmap.chunks {
+		end := start + uint64(len(chunk))/pageSize
+		if ptr < end {
+			offset := pageSize * (ptr - start)
+			return chunk[offset : offset+pageSize]
+		}
+		start = end
+	}
+	panic("bad ptr")
+}
+
+// the CRC32 of a page, skipping the checksum field in the header
+func pageChecksum(page []byte) uint32 {
+	crc := crc32.ChecksumIEEE(page[:4])
+	return crc32.Update(crc, crc32.IEEETable, page[HEADER:])
+}
+
+func setPageChecksum(page []byte) {
+	binary.LittleEndian.PutUint32(page[4:8], pageChecksum(page))
+}
+
+// ErrChecksum is the error the file store panics with when a page read
+// from the file doesn't match its checksum. the APIs of the tree recover
+// it into an error, see recoverChecksum and recoverUpdate
+var ErrChecksum = errors.New("page checksum mismatch")
+
+// the error of a panic with ErrChecksum, other panics go on
+func checksumPanic(r any) error {
+	if err, ok := r.(error); ok && errors.Is(err, ErrChecksum) {
+		return err
+	}
+	panic(r)
+}
+
+// deferred by the reads without an error to return, like Get: a panic with
+// ErrChecksum makes them return as if the KV was missing, and the error is
+// returned by Close. the panic goes on for a tree without a file to close
+func (tree *BTree) recoverChecksum() {
+	if r := recover(); r != nil {
+		if err := checksumPanic(r); !tree.readFailed(err) {
+			panic(err)
+		}
+	}
+}
+
+// deferred by the updates with an error to return, like Insert: a panic
+// with ErrChecksum reverts the tree to its last commit, as a failed commit
+// does, and is returned as the error. Close returns it too
+func (tree *BTree) recoverUpdate(err *error) {
+	if r := recover(); r != nil {
+		*err = checksumPanic(r)
+		switch store := tree.store.(type) {
+		case *FileStore:
+			store.rollback(tree)
+		case *dbStore:
+			store.rollback(store.db.catalog)
+			store.db.loadEntry(store.name, tree)
+		default:
+			panic(*err)
+		}
+		tree.snapshotCommitted(false)
+		tree.readFailed(*err)
+	}
+}
+
+// keep the first read error of a file-backed tree to be returned by Close
+func (tree *BTree) readFailed(err error) bool {
+	var store *FileStore
+	switch s := tree.store.(type) {
+	case *FileStore:
+		store = s
+	case *dbStore:
+		store = s.FileStore
+	default:
+		return false
+	}
+	if store.err == nil {
+		store.err = err
+	}
+	return true
+}
+
+// ErrReadOnly is returned when committing an update to a read-only file
+var ErrReadOnly = errors.New("the file is opened read-only")
+
+// read a flushed page and verify its checksum
+func (store *FileStore) pageReadChecked(ptr uint64) []byte {
+	page := store.pageRead(ptr)
+	if binary.LittleEndian.Uint32(page[4:8]) != pageChecksum(page) {
+		panic(fmt.Errorf("page %d: %w", ptr, ErrChecksum))
+	}
+	return page
+}
+
+// Get dereferences a page pointer.
+// it panics with ErrChecksum rather than returning a corrupted page,
+// which the tree recovers into an error
+func (store *FileStore) Get(ptr uint64) []byte {
+	utils.Assert(0 < ptr && ptr < store.page.flushed+uint64(len(store.page.temp)), "bad ptr")
+	if page, ok := store.page.updates[ptr]; ok {
+		return page
+	}
+	if ptr >= store.page.flushed {
+		return store.page.temp[ptr-store.page.flushed]
+	}
+	return store.pageReadChecked(ptr)
+}
+
+// New copies a node into a page, reusing a page from the free list if possible
+func (store *FileStore) New(node []byte) uint64 {
+	utils.Assert(int(BNode(node).nbytes()) <= store.pageSize, "node is greater than the defined page size")
+	page := make([]byte, store.pageSize)
+	copy(page, node)
+
+	if ptr, ok := flPop(&store.free); ok {
+		store.page.updates[ptr] = page
+		return ptr
+	}
+	return store.pageAppend(page)
+}
+
+// allocate a page at the end of the file
+func (store *FileStore) pageAppend(page []byte) uint64 {
+	ptr := store.page.flushed + uint64(len(store.page.temp))
+	store.page.temp = append(store.page.temp, page)
+	return ptr
+}
+
+// get a writable copy of an existing page, it's written back on flush
+func (store *FileStore) pageWrite(ptr uint64) []byte {
+	if page, ok := store.page.updates[ptr]; ok {
+		return page
+	}
+	if ptr >= store.page.flushed {
+		return store.page.temp[ptr-store.page.flushed]
+	}
+	page := make([]byte, store.pageSize)
+	copy(page, store.pageReadChecked(ptr))
+	store.page.updates[ptr] = page
+	return page
+}
+
+// Del deallocates a page, it can be reused once the update is committed
+func (store *FileStore) Del(ptr uint64) {
+	flPush(&store.free, ptr)
+}
+
+// Commit logs the update in the WAL, writes its pages into the file,
+// then points the meta page at the new root.
+// on failure the tree is reverted to the last committed root, unless only
+// the WAL couldn't be cleared after the meta page was saved
+func (store *FileStore) Commit(tree *BTree) error {
+	if store.readOnly {
+		store.rollback(tree)
+		if store.err == nil {
+			store.err = ErrReadOnly
+		}
+		return ErrReadOnly
+	}
+	err := store.walWrite(tree.root, tree.count)
+	if err == nil {
+		err = store.flush()
+	}
+	if err == nil {
+		err = saveMeta(store, tree.root, tree.count)
+	}
+	if err != nil {
+		store.rollback(tree)
+		if store.err == nil {
+			store.err = err
+		}
+		return err
+	}
+
+	store.root, store.count = tree.root, tree.count
+	store.free.setMaxSeq()
+	store.committed = store.free
+
+	// the update is in the meta page already, so it stays committed and the
+	// error is only returned by Close. the WAL left behind replays the same
+	// update on the next open
+	if err := store.walReset(); err != nil && store.err == nil {
+		store.err = err
+	}
+	return nil
+}
+
+// discard the pending update
+func (store *FileStore) rollback(tree *BTree) {
+	// the last commit is still intact in the file
+	if !store.readOnly {
+		store.walReset()
+	}
+	store.page.updates = map[uint64][]byte{}
+	store.page.temp = store.page.temp[:0]
+	store.free = store.committed
+	tree.root, tree.count = store.root, store.count
+}
+
+// write the pending pages to the file and make them durable
+func (store *FileStore) flush() error {
+	npages := int(store.page.flushed) + len(store.page.temp)
+	if err := store.extendMmap(npages); err != nil {
+		return err
+	}
+	if err := store.extendFile(npages); err != nil {
+		return err
+	}
+
+	// NOTE: the checksums are set by walWrite
+	for i, page := range store.page.temp {
+		ptr := store.page.flushed + uint64(i)
+		if _, err := store.fp.WriteAt(page, int64(ptr)*int64(store.pageSize)); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
+	}
+	for ptr, page := range store.page.updates {
+		if _, err := store.fp.WriteAt(page, int64(ptr)*int64(store.pageSize)); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
+	}
+	if err := store.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+
+	store.page.flushed += uint64(len(store.page.temp))
+	store.page.allocated = max(store.page.allocated, store.page.flushed)
+	store.page.temp = store.page.temp[:0]
+	store.page.updates = map[uint64][]byte{}
+	return nil
+}
+
+// Close unmaps and closes the file, returning the first commit error if any
+func (store *FileStore) Close() error {
+	err := store.release()
+	if store.err != nil {
+		return store.err
+	}
+	return err
+}
+
+func (store *FileStore) PageSize() int {
+	return store.pageSize
+}
+
+func (store *FileStore) release() error {
+	for _, chunk := range store.mmap.chunks {
+		syscall.Munmap(chunk)
+	}
+	store.mmap.chunks = nil
+	if store.wal != nil {
+		store.wal.Close()
+	}
+	return store.fp.Close()
+}
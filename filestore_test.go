@@ -0,0 +1,438 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a file with the keys a and b
+func testFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := tree.Insert([]byte(key), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadOnlyWritesFail(t *testing.T) {
+	tree, err := OpenFileReadOnly(testFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Insert([]byte("c"), []byte("new")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Insert: %v", err)
+	}
+	if ok, err := tree.Update([]byte("a"), []byte("new")); ok || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Update: %v %v", ok, err)
+	}
+	if ok, err := tree.InsertIfAbsent([]byte("c"), []byte("new")); ok || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("InsertIfAbsent: %v %v", ok, err)
+	}
+	if ok, err := tree.Delete([]byte("a")); ok || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Delete: %v %v", ok, err)
+	}
+	if n, err := tree.DeleteRange([]byte("a"), []byte("b")); n != 0 || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("DeleteRange: %d keys, %v", n, err)
+	}
+	if n, err := tree.FilterDelete(func([]byte, []byte) bool { return true }); n != 0 || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("FilterDelete: %d keys, %v", n, err)
+	}
+	if err := tree.Clear(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Clear: %v", err)
+	}
+
+	// the tree is left as it was in the file
+	if tree.Len() != 2 || tree.Exists([]byte("c")) {
+		t.Fatalf("%d keys", tree.Len())
+	}
+	for _, key := range []string{"a", "b"} {
+		if val, ok := tree.Get([]byte(key)); !ok || string(val) != "old" {
+			t.Fatalf("%s: %q %v", key, val, ok)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestReadOnlyReads(t *testing.T) {
+	tree, err := OpenFileReadOnly(testFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := tree.Get([]byte("b")); !ok || string(val) != "old" {
+		t.Fatalf("%q %v", val, ok)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateReportsFailures(t *testing.T) {
+	tree, err := OpenFile(testFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tree.Update(nil, []byte("new")); ok || err == nil {
+		t.Fatalf("empty key: %v %v", ok, err)
+	}
+	if ok, err := tree.Update([]byte("c"), []byte("new")); ok || err != nil {
+		t.Fatalf("absent key: %v %v", ok, err)
+	}
+
+	// writes to the file fail from now on
+	store := tree.store.(*FileStore)
+	store.fp.Close()
+	if ok, err := tree.Update([]byte("a"), []byte("new")); ok || err == nil {
+		t.Fatalf("failed commit: %v %v", ok, err)
+	}
+	if val, _ := tree.Get([]byte("a")); string(val) != "old" {
+		t.Fatalf("the update was kept: %q", val)
+	}
+	if err := tree.Close(); err == nil {
+		t.Fatal("Close succeeded")
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := tree.Insert([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a leaf and one of its keys
+	var leaf uint64
+	var key []byte
+	tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		if node.btype() == BNODE_LEAF && leaf == 0 && node.nkeys() > 1 {
+			leaf, key = ptr, bytes.Clone(node.getKey(1))
+		}
+		return true
+	})
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip the last byte of the leaf in the file
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b [1]byte
+	offset := int64(leaf+1)*BTREE_PAGE_SIZE - 1
+	if _, err := fp.ReadAt(b[:], offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := fp.WriteAt(b[:], offset); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	tree, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Verify: %v", err)
+	}
+	if _, ok := tree.Get(key); ok {
+		t.Fatal("Get served the corrupted page")
+	}
+	iter := tree.Iterate()
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	if !errors.Is(iter.Err(), ErrChecksum) || n >= 1000 {
+		t.Fatalf("Iterate: %d keys, %v", n, iter.Err())
+	}
+	if kvs, err := tree.GetRange([]byte("key"), []byte("key9"), 0); kvs != nil || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("GetRange: %d KVs, %v", len(kvs), err)
+	}
+	if err := tree.Export(io.Discard); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Export: %v", err)
+	}
+	if tree.ContentHash() != nil {
+		t.Fatal("ContentHash of a corrupted tree")
+	}
+	tree.Count([]byte("key"), []byte("key9"))
+	if root := tree.root; !errors.Is(tree.Compact(), ErrChecksum) || tree.root != root {
+		t.Fatal("Compact rebuilt a corrupted tree")
+	}
+	if n, err := tree.DeleteRange([]byte("key"), []byte("key9")); n != 0 || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("DeleteRange: %d keys, %v", n, err)
+	}
+	if n, err := tree.FilterDelete(func([]byte, []byte) bool { return true }); n != 0 || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("FilterDelete: %d keys, %v", n, err)
+	}
+
+	// the updates reaching the page fail and leave the tree as it was
+	root, count := tree.root, tree.count
+	if err := tree.Insert(key, []byte("new")); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Insert: %v", err)
+	}
+	if ok, err := tree.InsertIfAbsent(append(key, 'x'), nil); ok || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("InsertIfAbsent: %v %v", ok, err)
+	}
+	if ok, err := tree.Delete(key); ok || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Delete: %v %v", ok, err)
+	}
+	if tree.root != root || tree.count != count {
+		t.Fatal("the failed updates changed the tree")
+	}
+	if err := tree.Insert([]byte("zzz"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestFilePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := tree.Insert([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.Delete([]byte("key0000"))
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Len() != 2999 || tree.Exists([]byte("key0000")) {
+		t.Fatalf("%d keys", tree.Len())
+	}
+	for i := 1; i < 3000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if val, ok := tree.Get([]byte(key)); !ok || string(val) != "v"+key {
+			t.Fatalf("%s: %q %v", key, val, ok)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaPage(t *testing.T) {
+	path := testFile(t)
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100))
+	}
+	root, count := tree.root, tree.count
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.root != root || tree.count != count {
+		t.Fatalf("root %d with %d keys, want %d with %d", tree.root, tree.count, root, count)
+	}
+	tree.Close()
+
+	if _, err := OpenFileSize(path, 2*BTREE_PAGE_SIZE); err == nil || !strings.Contains(err.Error(), "page size mismatch") {
+		t.Fatalf("opened with another page size: %v", err)
+	}
+
+	// a file that is not a tree
+	other := filepath.Join(t.TempDir(), "other")
+	if err := os.WriteFile(other, bytes.Repeat([]byte("x"), 2*BTREE_PAGE_SIZE), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(other); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Fatalf("opened a file without the signature: %v", err)
+	}
+}
+
+func TestFreeListReusesPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	size := func() int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	var sizes []int64
+	kvs := make([]KV, 1000)
+	for i := range kvs {
+		kvs[i] = KV{Key: []byte(fmt.Sprintf("key%04d", i)), Val: make([]byte, 100)}
+	}
+	for round := 0; round < 16; round++ {
+		if err := tree.InsertBatch(kvs); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := tree.DeleteRange(nil, []byte("z")); n != len(kvs) || err != nil {
+			t.Fatalf("deleted %d keys: %v", n, err)
+		}
+		sizes = append(sizes, size())
+	}
+	// the first rounds fill the free list, then the file stops growing
+	if sizes[15] != sizes[7] {
+		t.Fatalf("file sizes %v", sizes)
+	}
+}
+
+func TestOpenFileReadsPageSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFileSize(path, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100))
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is opened with its own page size, not the default one
+	for _, open := range []func(string) (*BTree, error){OpenFile, OpenFileReadOnly} {
+		tree, err := open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree.pageSize() != 8192 || tree.Len() != 1000 {
+			t.Fatalf("page size %d, %d keys", tree.pageSize(), tree.Len())
+		}
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		tree.Close()
+	}
+
+	// a page size this build can't hold the largest KV in
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteAt(binary.LittleEndian.AppendUint64(nil, 1024), 16)
+	fp.Close()
+	if _, err := OpenFile(path); err == nil || !strings.Contains(err.Error(), "not supported by this build") {
+		t.Fatalf("opened a file of 1K pages: %v", err)
+	}
+}
+
+func TestSetExtent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.SetExtent(1000)
+	size := func() int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size() / BTREE_PAGE_SIZE
+	}
+	// the file grows once by the extent, the pages in use are tracked apart
+	store := tree.store.(*FileStore)
+	for i := 0; i < 100; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100))
+		if size() != 1002 || store.page.allocated != 1002 {
+			t.Fatalf("%d pages in the file, %d allocated", size(), store.page.allocated)
+		}
+	}
+	if store.page.flushed >= 1002 {
+		t.Fatalf("%d pages used", store.page.flushed)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unused pages at the end of the file are reused after reopening
+	tree, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 100; i < 200; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100))
+	}
+	if size() != 1002 || tree.Len() != 200 {
+		t.Fatalf("%d pages in the file, %d keys", size(), tree.Len())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a bulk load in commits of 100 keys, growing the file by the pages of each
+// commit or by extents of 1024 pages
+func BenchmarkFileExtent(b *testing.B) {
+	val := make([]byte, 100)
+	for _, extent := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("extent-%d", extent), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tree, err := OpenFile(filepath.Join(b.TempDir(), "db"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				tree.SetExtent(extent)
+				kvs := make([]KV, 100)
+				for start := 0; start < 20000; start += len(kvs) {
+					for j := range kvs {
+						kvs[j] = KV{Key: []byte(fmt.Sprintf("key%06d", start+j)), Val: val}
+					}
+					if err := tree.InsertBatch(kvs); err != nil {
+						b.Fatal(err)
+					}
+				}
+				tree.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package btree
+
+import (
+	"encoding/binary"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// the free list is an unrolled linked list of pages holding the pointers of
+// unused pages. items are popped from the head and pushed to the tail.
+// only the items before the tail of the last commit are popped, so pages
+// freed by an update are not reused until the update is durable.
+//
+// | type | unused | checksum | next | pointers |
+// |  2B  |   2B   |    4B    |  8B  | nitems*8 |
+const BNODE_FREE_LIST = 3
+
+const FREE_LIST_HEADER = 16
+
+type LNode []byte
+
+func (node LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[8:16])
+}
+
+func (node LNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[8:16], next)
+}
+
+func (node LNode) getPtr(idx int) uint64 {
+	offset := FREE_LIST_HEADER + 8*idx
+	return binary.LittleEndian.Uint64(node[offset:])
+}
+
+func (node LNode) setPtr(idx int, ptr uint64) {
+	utils.Assert(idx < flCap(len(node)), "index is greater than the free list node capacity")
+	offset := FREE_LIST_HEADER + 8*idx
+	binary.LittleEndian.PutUint64(node[offset:], ptr)
+}
+
+// the number of pointers in a free list node
+func flCap(pageSize int) int {
+	return (pageSize - FREE_LIST_HEADER) / 8
+}
+
+// an empty free list node
+func newLNode(pageSize int) LNode {
+	node := LNode(make([]byte, pageSize))
+	binary.LittleEndian.PutUint16(node[0:2], BNODE_FREE_LIST)
+	return node
+}
+
+type FreeList struct {
+	// callbacks for managing on-disk pages
+	get      func(uint64) []byte // read a page
+	new      func([]byte) uint64 // append a new page
+	set      func(uint64) []byte // update an existing page
+	pageSize int
+	// persisted data in the meta page
+	headPage uint64 // pointer to the list head node
+	headSeq  uint64 // monotonic sequence number to index into the list head
+	tailPage uint64
+	tailSeq  uint64
+	// in-memory states
+	maxSeq uint64 // saved `tailSeq` to prevent consuming newly added items
+}
+
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64(flCap(fl.pageSize)))
+}
+
+// make the items pushed so far available for reuse, called after a commit
+func (fl *FreeList) setMaxSeq() {
+	fl.maxSeq = fl.tailSeq
+}
+
+// remove 1 item from the head node, and the head node itself once it's consumed
+func flPopItem(fl *FreeList) (ptr uint64, head uint64, ok bool) {
+	if fl.headSeq == fl.maxSeq {
+		return 0, 0, false // cannot advance
+	}
+
+	node := LNode(fl.get(fl.headPage))
+	ptr = node.getPtr(fl.seq2idx(fl.headSeq))
+	fl.headSeq++
+	// move to the next node if the head node is empty
+	if fl.seq2idx(fl.headSeq) == 0 {
+		head, fl.headPage = fl.headPage, node.getNext()
+		utils.Assert(fl.headPage != 0, "free list is missing a node")
+	}
+	return ptr, head, true
+}
+
+// get a free page from the head of the list
+func flPop(fl *FreeList) (uint64, bool) {
+	ptr, head, ok := flPopItem(fl)
+	if head != 0 {
+		// the removed head node is a free page too
+		flPush(fl, head)
+	}
+	return ptr, ok
+}
+
+// add a free page to the tail of the list
+func flPush(fl *FreeList, ptr uint64) {
+	// add it to the tail node
+	LNode(fl.set(fl.tailPage)).setPtr(fl.seq2idx(fl.tailSeq), ptr)
+	fl.tailSeq++
+	if fl.seq2idx(fl.tailSeq) != 0 {
+		return
+	}
+
+	// the tail node is full, a new one is needed (the list is never empty).
+	// the bootstrap problem: the node is a page, so try to take it from the
+	// head of the list itself, and only append to the file if that fails
+	next, head, ok := flPopItem(fl)
+	if ok {
+		copy(fl.set(next), newLNode(fl.pageSize))
+	} else {
+		next = fl.new(newLNode(fl.pageSize))
+	}
+	// link to the new tail node
+	LNode(fl.set(fl.tailPage)).setNext(next)
+	fl.tailPage = next
+	// also add the head node if it was removed
+	if head != 0 {
+		LNode(fl.set(fl.tailPage)).setPtr(0, head)
+		fl.tailSeq++
+	}
+}
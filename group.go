@@ -0,0 +1,147 @@
+package btree
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// GroupCommit buffers the updates to a tree in memory and applies them in
+// a single commit once maxBatch keys are buffered or every flushInterval,
+// if it's positive, trading durability for write throughput: the buffered updates are lost
+// on a crash. reads see the buffered updates. it's safe for concurrent use,
+// and the tree must only be used through it until it's closed
+type GroupCommit struct {
+	mu       sync.Mutex
+	tree     *BTree
+	maxBatch int
+	pending  map[string]groupOp // the last update of each buffered key
+	err      error              // the first error of a flush not returned yet
+	stop     chan struct{}
+	stopped  sync.Once
+	done     chan struct{}
+}
+
+// a buffered update, a deletion if del is set
+type groupOp struct {
+	val []byte
+	del bool
+}
+
+// WithGroupCommit starts buffering the updates of the tree, see GroupCommit
+func (tree *BTree) WithGroupCommit(maxBatch int, flushInterval time.Duration) *GroupCommit {
+	gc := &GroupCommit{
+		tree: tree, maxBatch: maxBatch, pending: map[string]groupOp{},
+		stop: make(chan struct{}), done: make(chan struct{}),
+	}
+	if flushInterval > 0 {
+		go gc.run(flushInterval)
+	} else {
+		close(gc.done) // no background flush
+	}
+	return gc
+}
+
+// flush on the interval until closed
+func (gc *GroupCommit) run(flushInterval time.Duration) {
+	defer close(gc.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gc.mu.Lock()
+			if err := gc.flush(); err != nil && gc.err == nil {
+				gc.err = err
+			}
+			gc.mu.Unlock()
+		case <-gc.stop:
+			return
+		}
+	}
+}
+
+// Insert buffers a KV, flushing if the buffer is full
+func (gc *GroupCommit) Insert(key []byte, val []byte) error {
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.pending[string(key)] = groupOp{val: bytes.Clone(val)}
+	return gc.flushFull()
+}
+
+// Delete buffers the deletion of a key, returning false if it was not found.
+// an error flushing the buffer is returned by the next Flush or Close
+func (gc *GroupCommit) Delete(key []byte) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if _, ok := gc.get(key); !ok {
+		return false
+	}
+	gc.pending[string(key)] = groupOp{del: true}
+	if err := gc.flushFull(); err != nil && gc.err == nil {
+		gc.err = err
+	}
+	return true
+}
+
+// Get looks up a key, seeing the buffered updates
+func (gc *GroupCommit) Get(key []byte) ([]byte, bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.get(key)
+}
+
+func (gc *GroupCommit) get(key []byte) ([]byte, bool) {
+	if op, ok := gc.pending[string(key)]; ok {
+		return op.val, !op.del
+	}
+	return gc.tree.Get(key)
+}
+
+// Flush applies and commits the buffered updates now, returning the
+// error of the flush or of an earlier background one
+func (gc *GroupCommit) Flush() error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	err := gc.flush()
+	if gc.err != nil {
+		err, gc.err = gc.err, nil
+	}
+	return err
+}
+
+// Close flushes the buffered updates and stops buffering, the tree can be
+// used directly afterwards. closing again only flushes
+func (gc *GroupCommit) Close() error {
+	gc.stopped.Do(func() { close(gc.stop) })
+	<-gc.done
+	return gc.Flush()
+}
+
+func (gc *GroupCommit) flushFull() error {
+	if len(gc.pending) < gc.maxBatch {
+		return nil
+	}
+	return gc.flush()
+}
+
+// apply the buffered updates in a transaction. on failure they are
+// dropped, as the tree is reverted to its last commit
+func (gc *GroupCommit) flush() error {
+	if len(gc.pending) == 0 {
+		return nil
+	}
+	tx := gc.tree.Begin()
+	for key, op := range gc.pending {
+		if op.del {
+			tx.Delete([]byte(key))
+		} else {
+			tx.Insert([]byte(key), op.val)
+		}
+	}
+	gc.pending = map[string]groupOp{}
+	return tx.Commit()
+}
@@ -0,0 +1,87 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := tree.WithGroupCommit(100, time.Hour)
+	for i := 0; i < 99; i++ {
+		if err := gc.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// buffered, but visible to reads
+	if val, ok := gc.Get([]byte("key042")); !ok || string(val) != "v" || tree.Len() != 0 {
+		t.Fatalf("Get: %q %v, %d keys in the tree", val, ok, tree.Len())
+	}
+	if !gc.Delete([]byte("key042")) || gc.Delete([]byte("key042")) || gc.Delete([]byte("absent")) {
+		t.Fatal("Delete")
+	}
+	if _, ok := gc.Get([]byte("key042")); ok {
+		t.Fatal("a buffered deletion is not visible")
+	}
+
+	// the 100th buffered key flushes the buffer
+	gc.Insert([]byte("key099"), []byte("v"))
+	if tree.Len() != 99 {
+		t.Fatalf("%d keys in the tree", tree.Len())
+	}
+	gc.Insert([]byte("key100"), []byte("v"))
+	gc.Delete([]byte("key000"))
+	for i := 0; i < 2; i++ {
+		if err := gc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Len() != 99 || tree.Exists([]byte("key000")) || tree.Exists([]byte("key042")) || !tree.Exists([]byte("key100")) {
+		t.Fatalf("%d keys after reopening", tree.Len())
+	}
+
+	// flushed on the interval
+	gc = tree.WithGroupCommit(100, 10*time.Millisecond)
+	defer gc.Close()
+	gc.Insert([]byte("key200"), nil)
+	for i := 0; ; i++ {
+		gc.mu.Lock()
+		n := tree.Len()
+		gc.mu.Unlock()
+		if n == 100 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("not flushed on the interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// without an interval, only a full buffer or Flush commits
+	nogc := NewMemTree().WithGroupCommit(100, 0)
+	nogc.Insert([]byte("key"), nil)
+	if nogc.tree.Len() != 0 {
+		t.Fatal("flushed without an interval")
+	}
+	if err := nogc.Flush(); err != nil || nogc.tree.Len() != 1 {
+		t.Fatalf("Flush: %v, %d keys", err, nogc.tree.Len())
+	}
+	if err := nogc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+package btree
+
+// Index maps indexed values to the primary keys of the rows holding them,
+// e.g. as a secondary index of another tree. each mapping is a key of the
+// tree encoded with EncodeTuple(indexedVal, primaryKey) and an empty value,
+// so the primary keys of an indexed value are found with a prefix scan
+type Index struct {
+	tree *BTree
+}
+
+// NewIndex wraps a tree whose keys are all made by the Index
+func NewIndex(tree *BTree) *Index {
+	return &Index{tree: tree}
+}
+
+// Tree returns the underlying tree
+func (index *Index) Tree() *BTree {
+	return index.tree
+}
+
+// Put maps the indexed value to the primary key
+func (index *Index) Put(indexedVal []byte, primaryKey []byte) error {
+	return index.tree.Add(EncodeTuple(indexedVal, primaryKey))
+}
+
+// Delete removes a mapping, returning false if it wasn't there
+func (index *Index) Delete(indexedVal []byte, primaryKey []byte) (bool, error) {
+	return index.tree.Delete(EncodeTuple(indexedVal, primaryKey))
+}
+
+// Lookup returns the primary keys mapped to the indexed value in order
+func (index *Index) Lookup(indexedVal []byte) [][]byte {
+	var keys [][]byte
+	// the end of the encoded part makes the prefix match whole values only
+	for iter := index.tree.ScanPrefix(EncodeTuple(indexedVal)).KeyOnly(); iter.Next(); {
+		parts, err := DecodeTuple(iter.Key())
+		if err != nil || len(parts) != 2 {
+			panic("bad index key")
+		}
+		keys = append(keys, parts[1])
+	}
+	return keys
+}
@@ -0,0 +1,55 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	index := NewIndex(NewMemTree())
+	put := func(val string, keys ...string) {
+		for _, key := range keys {
+			if err := index.Put([]byte(val), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	lookup := func(val string) string {
+		var keys []string
+		for _, key := range index.Lookup([]byte(val)) {
+			keys = append(keys, string(key))
+		}
+		return fmt.Sprint(keys)
+	}
+	// "ab" is a prefix of "abc" and holds a zero byte, like the encoding
+	put("abc", "3", "1", "2")
+	put("ab", "4")
+	put("ab\x00", "5")
+	put("b", "1")
+
+	if got := lookup("abc"); got != "[1 2 3]" {
+		t.Fatalf("abc: %s", got)
+	}
+	if got := lookup("ab"); got != "[4]" {
+		t.Fatalf("ab: %s", got)
+	}
+	if got := lookup("ab\x00"); got != "[5]" {
+		t.Fatalf("ab\\x00: %s", got)
+	}
+	if got := lookup("a"); got != "[]" {
+		t.Fatalf("a: %s", got)
+	}
+
+	if ok, _ := index.Delete([]byte("abc"), []byte("2")); !ok {
+		t.Fatal("Delete")
+	}
+	if ok, _ := index.Delete([]byte("abc"), []byte("2")); ok {
+		t.Fatal("deleted a missing mapping")
+	}
+	if got := lookup("abc"); got != "[1 3]" {
+		t.Fatalf("abc after Delete: %s", got)
+	}
+	if n := index.Tree().Len(); n != 5 {
+		t.Fatalf("%d mappings", n)
+	}
+}
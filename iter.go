@@ -0,0 +1,402 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// Iter is a cursor over the KVs of the tree in key order.
+// since leaves are not chained, it keeps the path of nodes
+// from the root to the current leaf and an index into each of them.
+// leaves can't be chained with next-leaf pointers in a copy-on-write tree:
+// an updated leaf moves to a new page, so its left sibling would have to be
+// copied to point at it, then the sibling of that one, and so on up to the
+// first leaf. stepping to the next leaf only reads the nodes of the path
+// that change, which is once per internal node over a full scan, see
+// TestIterateReadsEachNodeOnce and BenchmarkScan.
+//
+//	iter := tree.Iterate()
+//	for iter.Next() {
+//		use(iter.Key(), iter.Val())
+//	}
+type Iter struct {
+	tree    *BTree
+	path    []BNode  // from the root to a leaf
+	pos     []uint16 // indexes into the nodes of the path
+	valid   bool     // the cursor points at a KV
+	fresh   bool     // the current KV has not been returned by Next yet
+	reverse bool     // Next walks keys in descending order
+	mods    uint64   // the tree.mods the path was read at
+	keyOnly bool     // values are not read, see KeyOnly
+	limited bool     // at most limit KVs are returned, see Limit
+	limit   int
+	nread   int   // KVs returned by Next since the cursor was positioned
+	err     error // ended the iteration, see Err
+	// ends the iteration at the first key it returns true for
+	stop func(key []byte) bool
+}
+
+// Iterate returns a cursor positioned before the first KV of the tree
+func (tree *BTree) Iterate() *Iter {
+	iter := &Iter{tree: tree}
+	iter.seek(nil, true)
+	return iter
+}
+
+// IterateReverse returns a cursor positioned after the last KV of the tree,
+// Next walks it towards the first KV
+func (tree *BTree) IterateReverse() *Iter {
+	iter := &Iter{tree: tree, reverse: true, fresh: true, mods: tree.mods}
+	if tree.root != 0 {
+		iter.seekLast()
+	}
+	return iter
+}
+
+// position the cursor at the last KV
+func (iter *Iter) seekLast() {
+	defer iter.recoverChecksum()
+	// descend to the rightmost leaf
+	iter.path, iter.pos = iter.path[:0], iter.pos[:0]
+	node := BNode(iter.tree.get(iter.tree.root))
+	for {
+		idx := node.nkeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		node = iter.tree.get(node.getPtr(idx))
+	}
+	iter.valid = !iterAtDummy(iter)
+}
+
+// Range bounds, the range is closed on both ends by default
+type RangeBound uint8
+
+const (
+	RANGE_INCLUSIVE     RangeBound = 0                                       // [start, end]
+	RANGE_EXCLUDE_START RangeBound = 1                                       // (start, end]
+	RANGE_EXCLUDE_END   RangeBound = 2                                       // [start, end)
+	RANGE_EXCLUSIVE     RangeBound = RANGE_EXCLUDE_START | RANGE_EXCLUDE_END // (start, end)
+)
+
+// Range returns a cursor over the KVs between start and end,
+// whether the bounds themselves are included is controlled by bound
+func (tree *BTree) Range(start []byte, end []byte, bound RangeBound) *Iter {
+	iter := &Iter{tree: tree}
+	if bound&RANGE_EXCLUDE_END != 0 {
+		iter.stop = func(key []byte) bool { return tree.compare(key, end) >= 0 }
+	} else {
+		iter.stop = func(key []byte) bool { return tree.compare(key, end) > 0 }
+	}
+	iter.seek(start, bound&RANGE_EXCLUDE_START == 0)
+	return iter
+}
+
+// ScanPrefix returns a cursor over the KVs whose keys start with prefix
+func (tree *BTree) ScanPrefix(prefix []byte) *Iter {
+	iter := &Iter{tree: tree}
+	iter.stop = func(key []byte) bool { return !bytes.HasPrefix(key, prefix) }
+	iter.seek(prefix, true)
+	return iter
+}
+
+// GetRange collects the KVs in [start, end], at most limit of them unless
+// limit is 0. unlike KV(), the returned KVs are copies owned by the caller.
+// the error is the one of the scan, see Iter.Err
+func (tree *BTree) GetRange(start []byte, end []byte, limit int) ([]KV, error) {
+	var kvs []KV
+	iter := tree.Range(start, end, RANGE_INCLUSIVE)
+	for iter.Next() {
+		if limit > 0 && len(kvs) == limit {
+			break
+		}
+		kv := iter.KV()
+		kvs = append(kvs, KV{Key: bytes.Clone(kv.Key), Val: bytes.Clone(kv.Val)})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+// Page collects copies of up to limit KVs after the key after, starting from
+// the first KV if after is empty. the returned token is the key to pass as
+// after to get the next page, it's nil once there are no KVs left
+func (tree *BTree) Page(after []byte, limit int) ([]KV, []byte) {
+	iter := &Iter{tree: tree}
+	iter.seek(after, len(after) == 0)
+	var kvs []KV
+	for iter.Next() {
+		if limit > 0 && len(kvs) == limit {
+			return kvs, kvs[len(kvs)-1].Key
+		}
+		kv := iter.KV()
+		kvs = append(kvs, KV{Key: bytes.Clone(kv.Key), Val: bytes.Clone(kv.Val)})
+	}
+	return kvs, nil
+}
+
+// Count returns the number of keys in [start, end] without reading the values.
+// with SubtreeCounts, the subtrees inside the range are skipped by their key
+// counts, otherwise every key in the range is visited
+func (tree *BTree) Count(start []byte, end []byte) int {
+	defer tree.recoverChecksum()
+	if tree.root != 0 && tree.hasCounts() {
+		le, _ := tree.countLE(end)
+		lt, found := tree.countLE(start)
+		if found {
+			lt--
+		}
+		return max(le-lt, 0)
+	}
+
+	n := 0
+	for iter := tree.Range(start, end, RANGE_INCLUSIVE).KeyOnly(); iter.Next(); {
+		n++
+	}
+	return n
+}
+
+// ForEach calls fn with each KV in key order until it returns false.
+// it walks the nodes directly without the cursor of Iterate,
+// the slices passed to fn are only valid until the tree is modified
+func (tree *BTree) ForEach(fn func(key []byte, val []byte) bool) {
+	if tree.root == 0 {
+		return
+	}
+	defer tree.recoverChecksum()
+	tree.forEach(tree.get(tree.root), true, fn)
+}
+
+// Stream sends copies of the KVs of the tree in key order on the returned
+// channel from a new goroutine, which closes the channel once all the KVs
+// are sent or ctx is done. the tree must not be updated until the channel
+// is closed, a Snapshot can be streamed instead
+func (tree *BTree) Stream(ctx context.Context) <-chan KV {
+	ch := make(chan KV)
+	go func() {
+		defer close(ch)
+		tree.ForEach(func(key []byte, val []byte) bool {
+			select {
+			case ch <- KV{Key: bytes.Clone(key), Val: bytes.Clone(val)}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return ch
+}
+
+// returns false once fn stops the walk
+func (tree *BTree) forEach(node BNode, leftmost bool, fn func([]byte, []byte) bool) bool {
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if leftmost && i == 0 {
+				continue // the dummy key
+			}
+			if !fn(node.getKey(i), tree.leafVal(node, i)) {
+				return false
+			}
+		}
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if !tree.forEach(tree.get(node.getPtr(i)), leftmost && i == 0, fn) {
+				return false
+			}
+		}
+	default:
+		panic("bad node!")
+	}
+	return true
+}
+
+// position the cursor at the last KV <= key, which might be the dummy key
+func iterSeekLE(iter *Iter, key []byte) {
+	iter.path, iter.pos = iter.path[:0], iter.pos[:0]
+	node := BNode(iter.tree.get(iter.tree.root))
+	for {
+		idx := nodeLookupLE(iter.tree, node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_LEAF {
+			return
+		}
+		node = iter.tree.get(node.getPtr(idx))
+	}
+}
+
+// the dummy key is the first KV of the leftmost leaf
+func iterAtDummy(iter *Iter) bool {
+	for _, idx := range iter.pos {
+		if idx != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// position the cursor at the first KV >= key, or > key if not inclusive.
+// a reverse cursor is positioned at the last KV <= key instead.
+// the KV is returned by the following call to Next
+func (iter *Iter) seek(key []byte, inclusive bool) {
+	iter.valid, iter.fresh = false, true
+	iter.mods = iter.tree.mods
+	iter.nread = 0
+	if iter.tree.root == 0 || iter.err != nil {
+		return
+	}
+	defer iter.recoverChecksum()
+
+	iterSeekLE(iter, key)
+	if iter.reverse {
+		iter.valid = !iterAtDummy(iter)
+		return
+	}
+
+	iter.valid = true
+	cmp := iter.tree.compare(iter.curKey(), key)
+	if iterAtDummy(iter) || cmp < 0 || cmp == 0 && !inclusive {
+		iter.valid = iterNext(iter, len(iter.path)-1)
+	}
+	iter.checkStop()
+}
+
+// Seek repositions the cursor at the first KV >= key, or the last KV <= key
+// when iterating in reverse. the KV is returned by the following call to
+// Next and the stop condition of a range still applies
+func (iter *Iter) Seek(key []byte) {
+	iter.seek(key, true)
+}
+
+// move the position of a level to the next KV,
+// moving to the next sibling node when this one is exhausted.
+// returns false and leaves the cursor untouched past the last KV
+func iterNext(iter *Iter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false // past the last key
+	} else {
+		// the parent moved to the next kid, start from its first KV
+		node := iter.path[level-1]
+		iter.path[level] = iter.tree.get(node.getPtr(iter.pos[level-1]))
+		iter.pos[level] = 0
+	}
+	return true
+}
+
+// move the position of a level to the previous KV,
+// moving to the previous sibling node when this one is exhausted.
+// returns false and leaves the cursor untouched before the first KV
+func iterPrev(iter *Iter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false // before the first key
+	} else {
+		// the parent moved to the previous kid, start from its last KV
+		node := iter.path[level-1]
+		kid := BNode(iter.tree.get(node.getPtr(iter.pos[level-1])))
+		iter.path[level] = kid
+		iter.pos[level] = kid.nkeys() - 1
+	}
+	return true
+}
+
+// Next moves the cursor to the next KV, returning false when there is none.
+// it panics if the tree was updated since the cursor was positioned,
+// as the nodes of the path may have been freed
+func (iter *Iter) Next() bool {
+	utils.Assert(iter.mods == iter.tree.mods, "the tree was modified during the iteration")
+	defer iter.recoverChecksum()
+	if iter.fresh {
+		iter.fresh = false
+	} else if iter.valid && iter.reverse {
+		// the dummy key is not a KV
+		iter.valid = iterPrev(iter, len(iter.path)-1) && !iterAtDummy(iter)
+		iter.checkStop()
+	} else if iter.valid {
+		iter.valid = iterNext(iter, len(iter.path)-1)
+		iter.checkStop()
+	}
+	if iter.valid && iter.limited {
+		if iter.nread == iter.limit {
+			iter.valid = false
+			return false
+		}
+		iter.nread++
+	}
+	return iter.valid
+}
+
+// Err returns the error that ended the iteration early, which is a page
+// failing its checksum. for a file-backed tree it's also returned by Close
+func (iter *Iter) Err() error {
+	return iter.err
+}
+
+// deferred by the moves of the cursor and Val, see BTree.recoverChecksum
+func (iter *Iter) recoverChecksum() {
+	if r := recover(); r != nil {
+		iter.err = checksumPanic(r)
+		iter.valid = false
+		iter.tree.readFailed(iter.err)
+	}
+}
+
+// end the iteration once the cursor is past the stop condition
+func (iter *Iter) checkStop() {
+	if iter.valid && iter.stop != nil && iter.stop(iter.curKey()) {
+		iter.valid = false
+	}
+}
+
+func (iter *Iter) curKey() []byte {
+	last := len(iter.path) - 1
+	return iter.path[last].getKey(iter.pos[last])
+}
+
+// Key returns the key at the cursor
+func (iter *Iter) Key() []byte {
+	utils.Assert(iter.valid && !iter.fresh, "iterator is not positioned at a KV")
+	return iter.curKey()
+}
+
+// KeyOnly makes the cursor return keys only, returning the cursor.
+// moving the cursor only reads the nodes on the path, the values are read
+// by Val, so a key-only scan never reads the overflow pages of large values.
+// Val and KV panic on a key-only cursor to catch accidental value reads
+func (iter *Iter) KeyOnly() *Iter {
+	iter.keyOnly = true
+	return iter
+}
+
+// Limit makes Next return at most n KVs, returning the cursor.
+// the count starts over when the cursor is repositioned by Seek,
+// so a Seek then n calls to Next reads the n KVs from a key
+func (iter *Iter) Limit(n int) *Iter {
+	utils.Assert(n >= 0, "negative limit")
+	iter.limited, iter.limit = true, n
+	return iter
+}
+
+// Val returns the value at the cursor
+func (iter *Iter) Val() []byte {
+	utils.Assert(iter.valid && !iter.fresh, "iterator is not positioned at a KV")
+	utils.Assert(!iter.keyOnly, "value read from a key-only iterator")
+	defer iter.recoverChecksum()
+	last := len(iter.path) - 1
+	return iter.tree.leafVal(iter.path[last], iter.pos[last])
+}
+
+// KV returns the key and the value at the cursor,
+// the slices are only valid until the tree is modified
+func (iter *Iter) KV() KV {
+	return KV{Key: iter.Key(), Val: iter.Val()}
+}
@@ -0,0 +1,488 @@
+package btree
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a tree of n keys of 100-byte values, several levels deep
+func testTree(n int) *BTree {
+	tree := NewMemTree()
+	val := make([]byte, 100)
+	for i := 0; i < n; i++ {
+		tree.insert([]byte(fmt.Sprintf("key%06d", i)), val, MODE_UPSERT)
+	}
+	tree.commit()
+	return tree
+}
+
+// count the pages read by the tree
+func countReads(tree *BTree) *int {
+	n := new(int)
+	get := tree.get
+	tree.get = func(ptr uint64) []byte {
+		*n++
+		return get(ptr)
+	}
+	return n
+}
+
+// without leaf chaining, a scan still reads every node exactly once
+func TestIterateReadsEachNodeOnce(t *testing.T) {
+	tree := testTree(20000)
+	stats := tree.Stats()
+	if stats.Height < 3 {
+		t.Fatalf("height %d", stats.Height)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		reads := countReads(tree)
+		var iter *Iter
+		if reverse {
+			iter = tree.IterateReverse()
+		} else {
+			iter = tree.Iterate()
+		}
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		if n != 20000 || *reads != stats.Nodes {
+			t.Fatalf("reverse %v: %d keys, %d reads of %d nodes", reverse, n, *reads, stats.Nodes)
+		}
+	}
+}
+
+// a full scan by the iterator, by ForEach, and by reading the leaves from
+// a list, which is the best a scan following leaf chaining could do
+func BenchmarkScan(b *testing.B) {
+	tree := testTree(100000)
+	b.Run("iter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for iter := tree.Iterate(); iter.Next(); {
+				iter.Val()
+			}
+		}
+	})
+	b.Run("foreach", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.ForEach(func([]byte, []byte) bool { return true })
+		}
+	})
+	b.Run("leaves", func(b *testing.B) {
+		var leaves []uint64
+		tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+			if node.btype() == BNODE_LEAF {
+				leaves = append(leaves, ptr)
+			}
+			return true
+		})
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, ptr := range leaves {
+				node := BNode(tree.get(ptr))
+				for j := uint16(0); j < node.nkeys(); j++ {
+					node.getKey(j)
+					tree.leafVal(node, j)
+				}
+			}
+		}
+	})
+}
+
+// the keys left in the iterator
+func iterKeys(iter *Iter) []string {
+	var keys []string
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return keys
+}
+
+func TestIterateSorted(t *testing.T) {
+	tree := NewMemTree()
+	if tree.Iterate().Next() {
+		t.Fatal("a KV in an empty tree")
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i*7919%1000) // every key in a shuffled order
+		tree.Insert([]byte(key), []byte("v"+key))
+	}
+
+	i := 0
+	for iter := tree.Iterate(); iter.Next(); i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if string(iter.Key()) != key || string(iter.Val()) != "v"+key {
+			t.Fatalf("KV %d is %q=%q", i, iter.Key(), iter.Val())
+		}
+	}
+	if i != 1000 {
+		t.Fatalf("%d KVs", i)
+	}
+}
+
+func TestRange(t *testing.T) {
+	tree := testTree(2000)
+	key := func(i int) string { return fmt.Sprintf("key%06d", i) }
+	for _, c := range []struct {
+		start, end string
+		bound      RangeBound
+		first, n   int
+	}{
+		{key(10), key(9), RANGE_INCLUSIVE, 0, 0},            // end before start
+		{"key000010x", "key000010y", RANGE_INCLUSIVE, 0, 0}, // between 2 keys
+		{key(10), key(10), RANGE_EXCLUSIVE, 0, 0},
+		{key(2000), "z", RANGE_INCLUSIVE, 0, 0}, // after the last key
+		{key(10), key(10), RANGE_INCLUSIVE, 10, 1},
+		{key(10), key(11), RANGE_EXCLUDE_START, 11, 1},
+		{key(10), key(11), RANGE_EXCLUDE_END, 10, 1},
+		{"", "key000009z", RANGE_INCLUSIVE, 0, 10}, // from the first key
+		// over many leaves of ~30 KVs
+		{key(100), key(1500), RANGE_INCLUSIVE, 100, 1401},
+		{key(100), key(1500), RANGE_EXCLUSIVE, 101, 1399},
+		{"key0019955", "z", RANGE_INCLUSIVE, 1996, 4}, // to the last key
+	} {
+		keys := iterKeys(tree.Range([]byte(c.start), []byte(c.end), c.bound))
+		if len(keys) != c.n {
+			t.Fatalf("%s-%s %d: %d keys, want %d", c.start, c.end, c.bound, len(keys), c.n)
+		}
+		for i, k := range keys {
+			if k != key(c.first+i) {
+				t.Fatalf("%s-%s %d: key %d is %s", c.start, c.end, c.bound, i, k)
+			}
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	tree := testTree(2000)
+	iter := tree.Iterate()
+	for _, c := range []struct{ seek, want string }{
+		{"key001500", "key001500"},
+		{"key000010x", "key000011"}, // the next key
+		{"key001998", "key001998"},
+		{"", "key000000"},
+		{"key000700", "key000700"},
+	} {
+		iter.Seek([]byte(c.seek))
+		if !iter.Next() || string(iter.Key()) != c.want {
+			t.Fatalf("seek %s: %q, want %s", c.seek, iter.Key(), c.want)
+		}
+		// the cursor goes on from there
+		if !iter.Next() || string(iter.Key()) <= c.want {
+			t.Fatalf("after %s: %q", c.want, iter.Key())
+		}
+	}
+	iter.Seek([]byte("key001999"))
+	if !iter.Next() || iter.Next() {
+		t.Fatal("seek to the last key")
+	}
+	iter.Seek([]byte("z"))
+	if iter.Next() {
+		t.Fatalf("seek past the last key: %q", iter.Key())
+	}
+
+	reverse := tree.IterateReverse()
+	reverse.Seek([]byte("key000010x"))
+	if !reverse.Next() || string(reverse.Key()) != "key000010" {
+		t.Fatalf("reverse seek: %q", reverse.Key())
+	}
+}
+
+func TestIterateReverseMirrorsForward(t *testing.T) {
+	tree := testTree(2000)
+	forward, reverse := iterKeys(tree.Iterate()), iterKeys(tree.IterateReverse())
+	if len(forward) != 2000 || len(reverse) != 2000 {
+		t.Fatalf("%d keys forward, %d in reverse", len(forward), len(reverse))
+	}
+	for i := range forward {
+		if forward[i] != reverse[len(reverse)-1-i] {
+			t.Fatalf("key %d is %s forward, %s in reverse", i, forward[i], reverse[len(reverse)-1-i])
+		}
+	}
+	if iterKeys(NewMemTree().IterateReverse()) != nil {
+		t.Fatal("a KV in an empty tree")
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	tree := testTree(3000)
+	kvs, err := tree.GetRange([]byte("key000100"), []byte("key002100"), 0)
+	if err != nil || len(kvs) != 2001 {
+		t.Fatalf("%d KVs, %v", len(kvs), err)
+	}
+	for i, kv := range kvs {
+		if string(kv.Key) != fmt.Sprintf("key%06d", 100+i) || len(kv.Val) != 100 {
+			t.Fatalf("KV %d is %q", i, kv.Key)
+		}
+	}
+	// the KVs are copies
+	tree.Delete([]byte("key000100"))
+	if string(kvs[0].Key) != "key000100" {
+		t.Fatalf("the KV changed to %q", kvs[0].Key)
+	}
+
+	if kvs, _ := tree.GetRange([]byte("key000100"), []byte("key002100"), 50); len(kvs) != 50 || string(kvs[49].Key) != "key000150" {
+		t.Fatalf("%d KVs with a limit", len(kvs))
+	}
+	if kvs, _ := tree.GetRange([]byte("b"), []byte("c"), 0); kvs != nil {
+		t.Fatalf("%d KVs in an empty range", len(kvs))
+	}
+}
+
+func TestPage(t *testing.T) {
+	tree := testTree(1000)
+	var keys []string
+	calls := 0
+	for token := []byte{}; token != nil; calls++ {
+		var kvs []KV
+		kvs, token = tree.Page(token, 100)
+		if len(kvs) != 100 {
+			t.Fatalf("page %d: %d KVs", calls, len(kvs))
+		}
+		for _, kv := range kvs {
+			keys = append(keys, string(kv.Key))
+		}
+	}
+	// the last page is full, but has no token
+	if calls != 10 || fmt.Sprint(keys) != fmt.Sprint(iterKeys(tree.Iterate())) {
+		t.Fatalf("%d keys in %d pages", len(keys), calls)
+	}
+
+	// a token removed between the calls still resumes after it
+	tree.Delete([]byte("key000099"))
+	kvs, token := tree.Page([]byte("key000099"), 100)
+	if len(kvs) != 100 || string(kvs[0].Key) != "key000100" || string(token) != "key000199" {
+		t.Fatalf("%d KVs from %q, token %q", len(kvs), kvs[0].Key, token)
+	}
+	if kvs, token := tree.Page([]byte("key000989"), 100); len(kvs) != 10 || token != nil {
+		t.Fatalf("%d KVs, token %q", len(kvs), token)
+	}
+	if kvs, token := NewMemTree().Page(nil, 100); len(kvs) != 0 || token != nil {
+		t.Fatalf("empty tree: %d KVs, token %q", len(kvs), token)
+	}
+}
+
+func TestCount(t *testing.T) {
+	tree := testTree(3000)
+	for _, c := range []struct {
+		start, end string
+		n          int
+	}{
+		{"", "z", 3000},
+		{"key000000", "key002999", 3000},
+		{"key000100", "key000199", 100},
+		{"key000100x", "key000200", 100},
+		{"key002990", "key009999", 10},
+		{"key000100", "key000100", 1},
+		{"key000200", "key000100", 0},
+		{"a", "b", 0},
+		{"key000100x", "key000100y", 0},
+	} {
+		if n := tree.Count([]byte(c.start), []byte(c.end)); n != c.n {
+			t.Fatalf("%s-%s: %d keys, want %d", c.start, c.end, n, c.n)
+		}
+	}
+	if n := NewMemTree().Count(nil, []byte("z")); n != 0 {
+		t.Fatalf("%d keys in an empty tree", n)
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	tree := NewMemTree()
+	keys := []string{"a", "ab", "abc", "abd", "ac", "b", "ba", "\xff", "\xff\xff", "\xff\xffa"}
+	for _, key := range keys {
+		tree.Insert([]byte(key), nil)
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("m%04d", i)), nil)
+	}
+
+	for _, c := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"ab", []string{"ab", "abc", "abd"}},
+		{"abc", []string{"abc"}},
+		{"a", []string{"a", "ab", "abc", "abd", "ac"}},
+		{"b", []string{"b", "ba"}},
+		{"abe", nil},
+		{"c", nil},
+		{"\xff\xff", []string{"\xff\xff", "\xff\xffa"}},
+	} {
+		if got := iterKeys(tree.ScanPrefix([]byte(c.prefix))); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Fatalf("%q: %q, want %q", c.prefix, got, c.want)
+		}
+	}
+	// across many leaves
+	if n := len(iterKeys(tree.ScanPrefix([]byte("m0")))); n != 1000 {
+		t.Fatalf("%d keys with the prefix m0", n)
+	}
+	if n := len(iterKeys(tree.ScanPrefix(nil))); n != tree.Len() {
+		t.Fatalf("%d keys with the empty prefix", n)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	tree := testTree(3000)
+	var keys []string
+	tree.ForEach(func(key []byte, val []byte) bool {
+		keys = append(keys, string(key))
+		return len(val) == 100
+	})
+	if fmt.Sprint(keys) != fmt.Sprint(iterKeys(tree.Iterate())) {
+		t.Fatalf("%d keys", len(keys))
+	}
+
+	// stopping early, also in the middle of a leaf
+	for _, stop := range []int{1, 17, 1500} {
+		n := 0
+		tree.ForEach(func([]byte, []byte) bool {
+			n++
+			return n < stop
+		})
+		if n != stop {
+			t.Fatalf("%d calls, stopped at %d", n, stop)
+		}
+	}
+	NewMemTree().ForEach(func([]byte, []byte) bool {
+		t.Fatal("a KV in an empty tree")
+		return false
+	})
+}
+
+func TestStream(t *testing.T) {
+	tree := testTree(3000)
+	before := runtime.NumGoroutine()
+	var keys []string
+	for kv := range tree.Stream(context.Background()) {
+		keys = append(keys, string(kv.Key))
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(iterKeys(tree.Iterate())) {
+		t.Fatalf("%d keys", len(keys))
+	}
+
+	// cancelled in the middle, without reading the channel further
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := tree.Stream(ctx)
+	for i := 0; i < 10; i++ {
+		<-ch
+	}
+	cancel()
+	// the goroutine is gone
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines, from %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("a KV after the cancel")
+	}
+}
+
+func TestIterateDetectsModification(t *testing.T) {
+	tree := testTree(1000)
+	iter := tree.Iterate()
+	iter.Next()
+	tree.Insert([]byte("key000500x"), nil)
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "modified during the iteration") {
+			t.Fatalf("recovered %v", r)
+		}
+	}()
+	iter.Next()
+	t.Fatal("the iterator went on after the tree was modified")
+}
+
+func TestIterateSeekAfterModification(t *testing.T) {
+	tree := testTree(1000)
+	iter := tree.Iterate()
+	iter.Next()
+	// a failed update doesn't change the tree
+	if ok, _ := tree.Delete([]byte("missing")); ok {
+		t.Fatal("deleted a missing key")
+	}
+	if !iter.Next() || string(iter.Key()) != "key000001" {
+		t.Fatalf("%q", iter.Key())
+	}
+	// a seek repositions the cursor on the new tree
+	tree.Delete([]byte("key000002"))
+	iter.Seek([]byte("key000002"))
+	if !iter.Next() || string(iter.Key()) != "key000003" {
+		t.Fatalf("%q", iter.Key())
+	}
+}
+
+func TestKeyOnly(t *testing.T) {
+	tree := NewMemTree()
+	for i := 0; i < 300; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 5000)) // 2 overflow pages each
+	}
+	nodes := tree.Stats().Nodes
+
+	reads := countReads(tree)
+	keys := iterKeys(tree.Iterate().KeyOnly())
+	if *reads != nodes {
+		t.Fatalf("%d reads for %d nodes", *reads, nodes)
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(iterKeys(tree.Iterate())) || len(keys) != 300 {
+		t.Fatalf("%d keys", len(keys))
+	}
+
+	*reads = 0
+	for iter := tree.Iterate(); iter.Next(); {
+		iter.Val()
+	}
+	if *reads != nodes+2*300 {
+		t.Fatalf("%d reads with the values", *reads)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("read a value from a key-only cursor")
+		}
+	}()
+	iter := tree.Iterate().KeyOnly()
+	iter.Next()
+	iter.Val()
+}
+
+func TestLimit(t *testing.T) {
+	tree := testTree(1000)
+	all := iterKeys(tree.Iterate())
+	for _, c := range []struct {
+		iter *Iter
+		want []string
+	}{
+		{tree.Iterate().Limit(5000), all},
+		{tree.Iterate().Limit(1000), all},
+		{tree.Iterate().Limit(0), nil},
+		{tree.Iterate().Limit(3), all[:3]},
+		{tree.IterateReverse().Limit(2), []string{all[999], all[998]}},
+		{tree.Range([]byte("key000100"), []byte("key000199"), RANGE_INCLUSIVE).Limit(200), all[100:200]},
+		{tree.ScanPrefix([]byte("key0005")).KeyOnly().Limit(10), all[500:510]},
+	} {
+		if got := iterKeys(c.iter); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Fatalf("%d keys, want %d", len(got), len(c.want))
+		}
+		// the cursor stays done
+		if c.iter.Next() {
+			t.Fatal("Next after the limit")
+		}
+	}
+
+	// top-N from a key, the count starts over at each Seek
+	iter := tree.Iterate().Limit(3)
+	for _, seek := range []string{"key000500", "key000010x"} {
+		iter.Seek([]byte(seek))
+		got := iterKeys(iter)
+		if len(got) != 3 || got[0] < seek {
+			t.Fatalf("seek %s: %v", seek, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// keys are compared byte by byte, so integers are encoded big-endian to
+// sort in numeric order (unlike the little-endian fields inside nodes).
+// a little-endian key starts with the lowest byte, so 256 (00 01 ...)
+// sorts before 1 (01 00 ...) and ranges over such keys are scrambled
+
+// EncodeUint64 encodes an integer as a key that sorts in numeric order,
+// never key an ordered tree with binary.LittleEndian instead
+func EncodeUint64(x uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, x)
+}
+
+// OrderPreservingUint64 is EncodeUint64, named for what it guarantees
+func OrderPreservingUint64(x uint64) []byte {
+	return EncodeUint64(x)
+}
+
+// DecodeUint64 decodes a key made by EncodeUint64
+func DecodeUint64(key []byte) (uint64, error) {
+	if len(key) != 8 {
+		return 0, fmt.Errorf("bad uint64 key of %d bytes", len(key))
+	}
+	return binary.BigEndian.Uint64(key), nil
+}
+
+// Uint64Tree is a tree keyed by integers
+type Uint64Tree struct {
+	tree *BTree
+}
+
+// NewUint64Tree wraps a tree whose keys are all made by EncodeUint64
+func NewUint64Tree(tree *BTree) *Uint64Tree {
+	return &Uint64Tree{tree: tree}
+}
+
+// Tree returns the underlying tree, e.g. for iterating in key order
+func (ut *Uint64Tree) Tree() *BTree {
+	return ut.tree
+}
+
+func (ut *Uint64Tree) Insert(key uint64, val []byte) error {
+	return ut.tree.Insert(EncodeUint64(key), val)
+}
+
+func (ut *Uint64Tree) Get(key uint64) ([]byte, bool) {
+	return ut.tree.Get(EncodeUint64(key))
+}
+
+func (ut *Uint64Tree) Delete(key uint64) (bool, error) {
+	return ut.tree.Delete(EncodeUint64(key))
+}
+
+// tuples are encoded as the concatenation of their parts, each one ending
+// with 0x00 0x00. a 0x00 inside a part is escaped as 0x00 0xff, so the end
+// of a part sorts before any byte that could continue it, which makes the
+// byte order of the keys match the lexicographic order of the tuples
+
+// EncodeTuple encodes multiple columns as a single key
+func EncodeTuple(parts ...[]byte) []byte {
+	var key []byte
+	for _, part := range parts {
+		for _, c := range part {
+			if c == 0 {
+				key = append(key, 0, 0xff)
+			} else {
+				key = append(key, c)
+			}
+		}
+		key = append(key, 0, 0)
+	}
+	return key
+}
+
+// DecodeTuple decodes a key made by EncodeTuple
+func DecodeTuple(key []byte) ([][]byte, error) {
+	var parts [][]byte
+	part := []byte{}
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0 {
+			part = append(part, key[i])
+			continue
+		}
+		if i+1 == len(key) {
+			return nil, errors.New("truncated tuple key")
+		}
+		i++
+		switch key[i] {
+		case 0:
+			parts = append(parts, part)
+			part = []byte{}
+		case 0xff:
+			part = append(part, 0)
+		default:
+			return nil, fmt.Errorf("bad escape byte %#x in tuple key", key[i])
+		}
+	}
+	if len(part) > 0 {
+		return nil, errors.New("truncated tuple key")
+	}
+	return parts, nil
+}
@@ -0,0 +1,155 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// integers across the byte boundaries, which are where little-endian breaks
+var orderedInts = []uint64{0, 1, 2, 255, 256, 257, 65535, 65536, 1 << 32, 1<<32 + 1, 1<<64 - 1}
+
+// the integers of the tree in key order, keyed with encode
+func intsInKeyOrder(t *testing.T, encode func(uint64) []byte, decode func([]byte) uint64) []uint64 {
+	t.Helper()
+	tree := NewMemTree()
+	for _, x := range orderedInts {
+		if err := tree.Insert(encode(x), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []uint64
+	for iter := tree.Iterate(); iter.Next(); {
+		got = append(got, decode(iter.Key()))
+	}
+	return got
+}
+
+func TestLittleEndianKeysAreScrambled(t *testing.T) {
+	got := intsInKeyOrder(t,
+		func(x uint64) []byte { return binary.LittleEndian.AppendUint64(nil, x) },
+		binary.LittleEndian.Uint64)
+	if slices.Equal(got, orderedInts) {
+		t.Fatal("little-endian keys sort in numeric order")
+	}
+	// 256 is 00 01 ..., it sorts before 1, which is 01 00 ...
+	if slices.Index(got, 256) > slices.Index(got, 1) {
+		t.Fatalf("%v", got)
+	}
+}
+
+func TestOrderPreservingUint64(t *testing.T) {
+	got := intsInKeyOrder(t, OrderPreservingUint64, binary.BigEndian.Uint64)
+	if !slices.Equal(got, orderedInts) {
+		t.Fatalf("%v", got)
+	}
+
+	for i, x := range orderedInts {
+		key := OrderPreservingUint64(x)
+		if !bytes.Equal(key, EncodeUint64(x)) {
+			t.Fatalf("%d: %x", x, key)
+		}
+		if y, err := DecodeUint64(key); err != nil || y != x {
+			t.Fatalf("%d: decoded %d %v", x, y, err)
+		}
+		if i > 0 && bytes.Compare(OrderPreservingUint64(orderedInts[i-1]), key) >= 0 {
+			t.Fatalf("%d sorts before %d", x, orderedInts[i-1])
+		}
+	}
+	if _, err := DecodeUint64([]byte{1, 2, 3}); err == nil {
+		t.Fatal("decoded a short key")
+	}
+}
+
+func TestOrderPreservingRange(t *testing.T) {
+	tree := NewMemTree()
+	for x := uint64(0); x < 1000; x++ {
+		if err := tree.Insert(OrderPreservingUint64(x), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the range crosses the 255/256 boundary
+	var got []uint64
+	for iter := tree.Range(OrderPreservingUint64(250), OrderPreservingUint64(260), RANGE_INCLUSIVE); iter.Next(); {
+		x, _ := DecodeUint64(iter.Key())
+		got = append(got, x)
+	}
+	want := []uint64{250, 251, 252, 253, 254, 255, 256, 257, 258, 259, 260}
+	if !slices.Equal(got, want) {
+		t.Fatalf("%v", got)
+	}
+}
+
+func TestUint64Tree(t *testing.T) {
+	ut := NewUint64Tree(NewMemTree())
+	for _, x := range []uint64{1<<64 - 1, 256, 0, 255, 1} {
+		if err := ut.Insert(x, EncodeUint64(x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []uint64
+	for iter := ut.Tree().Iterate(); iter.Next(); {
+		x, err := DecodeUint64(iter.Key())
+		if err != nil || !bytes.Equal(iter.Val(), iter.Key()) {
+			t.Fatalf("%x=%x: %v", iter.Key(), iter.Val(), err)
+		}
+		got = append(got, x)
+	}
+	if want := []uint64{0, 1, 255, 256, 1<<64 - 1}; !slices.Equal(got, want) {
+		t.Fatalf("%v, want %v", got, want)
+	}
+
+	if val, ok := ut.Get(256); !ok || !bytes.Equal(val, EncodeUint64(256)) {
+		t.Fatalf("Get: %x %v", val, ok)
+	}
+	if ok, _ := ut.Delete(256); !ok {
+		t.Fatal("Delete")
+	}
+	if ok, _ := ut.Delete(256); ok {
+		t.Fatal("deleted a missing key")
+	}
+	if _, ok := ut.Get(256); ok {
+		t.Fatal("the key is still there")
+	}
+}
+
+func TestTupleOrder(t *testing.T) {
+	b := func(s string) []byte { return []byte(s) }
+	// in tuple order
+	tuples := [][][]byte{
+		{},
+		{b("")},
+		{b(""), b("z")},
+		{b("a")},
+		{b("a"), b("")},
+		{b("a"), b("bc")},
+		{b("a\x00")}, // 0x00 is escaped
+		{b("a\x00"), b("a")},
+		{b("a\x01")},
+		{b("ab"), b("c")},
+		{b("ab\xff")},
+		{b("b"), b("a"), b("a")},
+	}
+	for i, tuple := range tuples {
+		key := EncodeTuple(tuple...)
+		parts, err := DecodeTuple(key)
+		if err != nil || len(parts) != len(tuple) {
+			t.Fatalf("%q: decoded %q %v", tuple, parts, err)
+		}
+		for j := range parts {
+			if !bytes.Equal(parts[j], tuple[j]) {
+				t.Fatalf("%q: decoded %q", tuple, parts)
+			}
+		}
+		if i > 0 && bytes.Compare(EncodeTuple(tuples[i-1]...), key) >= 0 {
+			t.Fatalf("%q sorts before %q", tuple, tuples[i-1])
+		}
+	}
+
+	for _, key := range []string{"a", "a\x00", "a\x00\x01", "a\x00\x00b"} {
+		if parts, err := DecodeTuple([]byte(key)); err == nil {
+			t.Fatalf("%q: decoded %q", key, parts)
+		}
+	}
+}
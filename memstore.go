@@ -0,0 +1,91 @@
+package btree
+
+import (
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// MemStore keeps pages in memory, for using the tree without a file.
+// page ids are allocated in order from 1 and never reused, so the same
+// updates on a new store always produce the same ids, see Dump
+type MemStore struct {
+	pages    map[uint64][]byte
+	next     uint64 // the id of the next allocated page, 0 is the null pointer
+	pageSize int
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{pages: map[uint64][]byte{}, next: 1, pageSize: BTREE_PAGE_SIZE}
+}
+
+// NewMemStoreSize returns a MemStore with pages of a custom size
+func NewMemStoreSize(pageSize int) (*MemStore, error) {
+	if err := checkPageSize(pageSize); err != nil {
+		return nil, err
+	}
+	store := NewMemStore()
+	store.pageSize = pageSize
+	return store, nil
+}
+
+// NewMemTree returns an empty tree backed by a MemStore
+func NewMemTree() *BTree {
+	return newTree(NewMemStore())
+}
+
+// NewMemTreeSize returns an empty tree backed by a MemStore with a custom page size
+func NewMemTreeSize(pageSize int) (*BTree, error) {
+	store, err := NewMemStoreSize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return newTree(store), nil
+}
+
+// Get dereferences a page pointer
+func (store *MemStore) Get(ptr uint64) []byte {
+	page, ok := store.pages[ptr]
+	utils.Assert(ok, "page not found")
+	return page
+}
+
+// New copies a node into a newly allocated page
+func (store *MemStore) New(node []byte) uint64 {
+	utils.Assert(int(BNode(node).nbytes()) <= store.pageSize, "node is greater than the defined page size")
+	ptr := store.next
+	store.next++
+	page := make([]byte, store.pageSize)
+	copy(page, node)
+	store.pages[ptr] = page
+	return ptr
+}
+
+// Del deallocates a page
+func (store *MemStore) Del(ptr uint64) {
+	_, ok := store.pages[ptr]
+	utils.Assert(ok, "page not found")
+	delete(store.pages, ptr)
+}
+
+// Dump returns every allocated page by its id, e.g. for comparing the
+// structure of a tree against the expected one. the pages are not copied
+// and must not be modified
+func (store *MemStore) Dump() map[uint64]BNode {
+	pages := make(map[uint64]BNode, len(store.pages))
+	for ptr, page := range store.pages {
+		pages[ptr] = page
+	}
+	return pages
+}
+
+// Commit is a no-op, the pages are already in place
+func (store *MemStore) Commit(tree *BTree) error {
+	return nil
+}
+
+func (store *MemStore) Close() error {
+	return nil
+}
+
+func (store *MemStore) PageSize() int {
+	return store.pageSize
+}
@@ -0,0 +1,135 @@
+package btree
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// every page of the store is a node of the tree or holds one of its large
+// values, so none are leaked
+func checkNoLeak(t *testing.T, tree *BTree) {
+	t.Helper()
+	store := tree.store.(*MemStore)
+	if nodes := tree.Stats().Nodes + overflowPages(tree); len(store.pages) != nodes {
+		t.Fatalf("%d pages for %d nodes", len(store.pages), nodes)
+	}
+}
+
+func TestMemTree(t *testing.T) {
+	tree := NewMemTree()
+	for i := 0; i < 3000; i++ {
+		if err := tree.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkNoLeak(t, tree)
+	if val, ok := tree.Get([]byte("key1234")); !ok || string(val) != "1234" {
+		t.Fatalf("Get: %q %v", val, ok)
+	}
+	if ok, err := tree.Update([]byte("key1234"), []byte("new")); !ok || err != nil {
+		t.Fatalf("Update: %v %v", ok, err)
+	}
+	if val, _ := tree.Get([]byte("key1234")); string(val) != "new" {
+		t.Fatalf("Get after Update: %q", val)
+	}
+
+	for i := 0; i < 3000; i += 2 {
+		if ok, _ := tree.Delete([]byte(fmt.Sprintf("key%04d", i))); !ok {
+			t.Fatalf("Delete key%04d", i)
+		}
+	}
+	checkNoLeak(t, tree)
+	if tree.Len() != 1500 || tree.Exists([]byte("key1234")) || !tree.Exists([]byte("key1235")) {
+		t.Fatalf("%d keys left", tree.Len())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPageSize8K(t *testing.T) {
+	tree, err := NewMemTreeSize(8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if err := tree.Insert([]byte(fmt.Sprintf("key%04d", i*7919%5000)), make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		if val, ok := tree.Get([]byte(fmt.Sprintf("key%04d", i))); !ok || len(val) != 100 {
+			t.Fatalf("key%04d: %v", i, ok)
+		}
+	}
+	for i := 0; i < 5000; i += 2 {
+		tree.Delete([]byte(fmt.Sprintf("key%04d", i)))
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLeak(t, tree)
+
+	// the nodes use the larger pages
+	big := false
+	tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		big = big || node.nbytes() > BTREE_PAGE_SIZE
+		return true
+	})
+	if !big || tree.Len() != 2500 {
+		t.Fatalf("%d keys, nodes over 4K %v", tree.Len(), big)
+	}
+}
+
+// the pages of a store in id order, one line each: the id, the node type
+// and the keys, with the kids of internal nodes
+func dumpPages(store *MemStore) string {
+	pages := store.Dump()
+	var ptrs []uint64
+	for ptr := range pages {
+		ptrs = append(ptrs, ptr)
+	}
+	slices.Sort(ptrs)
+	var lines []string
+	for _, ptr := range ptrs {
+		node := pages[ptr]
+		line := fmt.Sprintf("%d: %d", ptr, node.btype())
+		for i := uint16(0); i < node.nkeys(); i++ {
+			line += fmt.Sprintf(" %q", node.getKey(i))
+			if node.btype() == BNODE_NODE {
+				line += fmt.Sprintf("->%d", node.getPtr(i))
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestDumpStructure(t *testing.T) {
+	build := func() *BTree {
+		tree := NewMemTree()
+		for _, key := range []string{"d", "b", "f", "a", "c", "e", "g"} {
+			tree.Insert([]byte(key), make([]byte, 1000))
+		}
+		tree.Delete([]byte("g"))
+		return tree
+	}
+	// a leaf holds up to 4 values of 1000 bytes
+	want := strings.Join([]string{
+		`5: 2 "" "a" "b"`,
+		`13: 2 "c" "d" "e" "f"`,
+		`14: 1 ""->5 "c"->13`,
+	}, "\n")
+	if got := dumpPages(build().store.(*MemStore)); got != want {
+		t.Fatalf("pages:\n%s\nwant:\n%s", got, want)
+	}
+	// the same updates allocate the same ids
+	if dumpPages(build().store.(*MemStore)) != want {
+		t.Fatal("the page ids changed")
+	}
+}
@@ -0,0 +1,46 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Merge inserts the KVs of src into the tree and commits once. for a key in
+// both trees, the value becomes onConflict(key, dstVal, srcVal), or the one
+// of src if onConflict is nil. both trees are walked together in key order,
+// so the values of the tree are only read for the keys of src, then the KVs
+// are applied as a batch like InsertBatch, or bulk loaded into an empty tree.
+// the trees must have the same order, see Cmp
+func (dst *BTree) Merge(src *BTree, onConflict func(key, dstVal, srcVal []byte) []byte) error {
+	var kvs []KV
+	cur := dst.Iterate()
+	more := cur.Next()
+	iter := src.Iterate()
+	for iter.Next() {
+		key, val := iter.Key(), iter.Val()
+		for more && dst.compare(cur.Key(), key) < 0 {
+			more = cur.Next()
+		}
+		if more && dst.compare(cur.Key(), key) == 0 && onConflict != nil {
+			old := cur.Val()
+			val = onConflict(key, old, val)
+			if bytes.Equal(val, old) {
+				continue // unchanged
+			}
+		}
+		kvs = append(kvs, KV{Key: bytes.Clone(key), Val: bytes.Clone(val)})
+	}
+	if err := errors.Join(iter.Err(), cur.Err()); err != nil {
+		return err
+	}
+	if len(kvs) == 0 {
+		return nil
+	}
+
+	if dst.root == 0 {
+		dst.bulkLoad(kvs)
+	} else {
+		dst.insertBatch(kvs)
+	}
+	return dst.commit()
+}
@@ -0,0 +1,69 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// a tree of the keys from start to end, with values made of tag and the key
+func mergeTree(start, end int, tag string) *BTree {
+	tree := NewMemTree()
+	for i := start; i < end; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("%s%04d", tag, i)))
+	}
+	return tree
+}
+
+func TestMerge(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		onConflict func(key, dstVal, srcVal []byte) []byte
+		want       string // the tag of the values of the keys in both trees
+	}{
+		{"src wins", nil, "src"},
+		{"dst wins", func(key, dstVal, srcVal []byte) []byte { return dstVal }, "dst"},
+		{"combined", func(key, dstVal, srcVal []byte) []byte { return append(bytes.Clone(dstVal), srcVal...) }, "both"},
+	} {
+		// keys 0-2999 in dst, 2000-3999 in src
+		dst, src := mergeTree(0, 3000, "dst"), mergeTree(2000, 4000, "src")
+		if err := dst.Merge(src, c.onConflict); err != nil {
+			t.Fatal(err)
+		}
+		if dst.Len() != 4000 || src.Len() != 2000 {
+			t.Fatalf("%s: %d keys", c.name, dst.Len())
+		}
+		for i := 0; i < 4000; i++ {
+			val, _ := dst.Get([]byte(fmt.Sprintf("key%04d", i)))
+			want := fmt.Sprintf("dst%04d", i)
+			switch {
+			case i >= 3000:
+				want = fmt.Sprintf("src%04d", i)
+			case i >= 2000 && c.want == "src":
+				want = fmt.Sprintf("src%04d", i)
+			case i >= 2000 && c.want == "both":
+				want = fmt.Sprintf("dst%04dsrc%04d", i, i)
+			}
+			if string(val) != want {
+				t.Fatalf("%s: key%04d is %q, want %q", c.name, i, val, want)
+			}
+		}
+		if err := dst.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		checkNoLeak(t, dst)
+	}
+
+	// into an empty tree, and from one
+	dst, src := NewMemTree(), mergeTree(0, 1000, "src")
+	if err := dst.Merge(src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !sameKVs(treeKVs(dst), treeKVs(src)) {
+		t.Fatalf("%d keys", dst.Len())
+	}
+	hash := dst.ContentHash()
+	if err := dst.Merge(NewMemTree(), nil); err != nil || !bytes.Equal(dst.ContentHash(), hash) {
+		t.Fatalf("merging an empty tree: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package btree
+
+import (
+	"slices"
+)
+
+// MultiGet looks up many keys at once, returning their values in the order
+// of the keys, with nil for the keys that are not found. the keys are
+// sorted and routed down the tree together, so each node on the way is
+// visited once no matter how many of the keys fall into it
+func (tree *BTree) MultiGet(keys [][]byte) [][]byte {
+	defer tree.recoverChecksum()
+	vals := make([][]byte, len(keys))
+	if tree.root == 0 || len(keys) == 0 {
+		return vals
+	}
+
+	// the indexes of the keys in key order
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a int, b int) int {
+		return tree.compare(keys[a], keys[b])
+	})
+	tree.multiGet(tree.get(tree.root), keys, order, vals)
+	return vals
+}
+
+// look up the keys of order, which all fall into the node
+func (tree *BTree) multiGet(node BNode, keys [][]byte, order []int, vals [][]byte) {
+	switch node.btype() {
+	case BNODE_LEAF:
+		for _, i := range order {
+			idx := nodeLookupLE(tree, node, keys[i])
+			// the dummy key is not a KV
+			if len(keys[i]) > 0 && tree.compare(keys[i], node.getKey(idx)) == 0 {
+				vals[i] = tree.leafVal(node, idx)
+			}
+		}
+	case BNODE_NODE:
+		// each kid gets the keys up to the key of the next kid
+		start := 0
+		for idx := uint16(0); idx < node.nkeys() && start < len(order); idx++ {
+			end := len(order)
+			if idx+1 < node.nkeys() {
+				next := node.getKey(idx + 1)
+				for end = start; end < len(order) && tree.compare(keys[order[end]], next) < 0; end++ {
+				}
+			}
+			if start < end {
+				tree.multiGet(tree.get(node.getPtr(idx)), keys, order[start:end], vals)
+			}
+			start = end
+		}
+	default:
+		panic("bad node!")
+	}
+}
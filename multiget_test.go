@@ -0,0 +1,65 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// n random keys of testTree, half of them missing
+func randomKeys(n int, max int) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%06d", rng.Intn(2*max)))
+	}
+	return keys
+}
+
+func TestMultiGet(t *testing.T) {
+	tree := testTree(20000)
+	for i := 0; i < 20000; i += 3 {
+		tree.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprint(i)))
+	}
+	keys := randomKeys(10000, 20000)
+	keys = append(keys, keys[0], nil, []byte("a"), []byte("z"))
+
+	vals := tree.MultiGet(keys)
+	if len(vals) != len(keys) {
+		t.Fatalf("%d values for %d keys", len(vals), len(keys))
+	}
+	for i, key := range keys {
+		val, ok := tree.Get(key)
+		if !bytes.Equal(vals[i], val) || (vals[i] == nil) == ok {
+			t.Fatalf("%q: %q, want %q", key, vals[i], val)
+		}
+	}
+	// each node is read at most once
+	nodes := tree.Stats().Nodes
+	reads := countReads(tree)
+	tree.MultiGet(keys)
+	if *reads > nodes {
+		t.Fatalf("%d reads for %d nodes", *reads, nodes)
+	}
+	if vals := NewMemTree().MultiGet(keys); len(vals) != len(keys) || vals[0] != nil {
+		t.Fatal("MultiGet on an empty tree")
+	}
+}
+
+func BenchmarkMultiGet(b *testing.B) {
+	tree := testTree(100000)
+	keys := randomKeys(10000, 100000)
+	b.Run("multiget", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.MultiGet(keys)
+		}
+	})
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				tree.Get(key)
+			}
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package btree
+
+// Observer is told about the work done by a tree, e.g. to count it in
+// metrics without this package depending on a metrics library.
+// the calls are made synchronously during the operations, so they must be cheap
+type Observer interface {
+	OnSplit()               // a node was split into 2 or 3 nodes
+	OnMerge()               // 2 sibling nodes were merged into 1
+	OnPageRead(ptr uint64)  // a page was read through the get callback
+	OnPageWrite(ptr uint64) // a page was allocated through the new callback
+	OnInsert()              // a KV was added or its value replaced
+	OnDelete()              // a key was removed
+}
+
+// Observe reports the work of the tree to obs. page reads and writes are
+// observed by wrapping the callbacks of the tree, so it must be set up
+// before the tree is used, like UseCache. without an observer the other
+// calls cost a nil check
+func (tree *BTree) Observe(obs Observer) {
+	get, new := tree.get, tree.new
+	tree.get = func(ptr uint64) []byte {
+		obs.OnPageRead(ptr)
+		return get(ptr)
+	}
+	tree.new = func(node []byte) uint64 {
+		ptr := new(node)
+		obs.OnPageWrite(ptr)
+		return ptr
+	}
+	tree.obs = obs
+}
+
+// report a node split into nsplit nodes, if it was split
+func (tree *BTree) observeSplit(nsplit int) {
+	if tree.obs != nil && nsplit > 1 {
+		tree.obs.OnSplit()
+	}
+}
@@ -0,0 +1,45 @@
+package btree
+
+import "testing"
+
+// counts the calls of each kind
+type countObserver struct {
+	splits, merges, reads, writes, inserts, deletes int
+}
+
+func (obs *countObserver) OnSplit()           { obs.splits++ }
+func (obs *countObserver) OnMerge()           { obs.merges++ }
+func (obs *countObserver) OnPageRead(uint64)  { obs.reads++ }
+func (obs *countObserver) OnPageWrite(uint64) { obs.writes++ }
+func (obs *countObserver) OnInsert()          { obs.inserts++ }
+func (obs *countObserver) OnDelete()          { obs.deletes++ }
+
+func TestObserver(t *testing.T) {
+	tree := NewMemTree()
+	obs := &countObserver{}
+	tree.Observe(obs)
+	// a leaf holds up to 4 values of 1000 bytes, so the last insert splits
+	// the root leaf into 2 leaves under a new root. each insert after the
+	// first reads the root and writes the new copies
+	for _, key := range []string{"d", "b", "f", "a", "c"} {
+		tree.Insert([]byte(key), make([]byte, 1000))
+	}
+	want := countObserver{splits: 1, reads: 4, writes: 7, inserts: 5}
+	if *obs != want {
+		t.Fatalf("inserts: %+v, want %+v", *obs, want)
+	}
+
+	// the first delete merges the 2 leaves into the new root, the missing
+	// keys only cost the reads of the lookups
+	*obs = countObserver{}
+	tree.Delete([]byte("a"))
+	tree.Delete([]byte("b"))
+	tree.Delete([]byte("x"))
+	if ok, _ := tree.Update([]byte("x"), nil); ok {
+		t.Fatal("updated a missing key")
+	}
+	want = countObserver{merges: 1, reads: 7, writes: 2, deletes: 2}
+	if *obs != want {
+		t.Fatalf("deletes: %+v, want %+v", *obs, want)
+	}
+}
@@ -0,0 +1,92 @@
+package btree
+
+import (
+	"encoding/binary"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// values larger than BTREE_MAX_VAL_SIZE are stored in a chain of overflow
+// pages. the leaf keeps the first page in the pointer of the KV, which is
+// otherwise unused in leaves, and the total length of the value as the value.
+//
+// | type | unused | checksum | next | data |
+// |  2B  |   2B   |    4B    |  8B  | ...  |
+const BNODE_OVERFLOW = 4
+
+const OVERFLOW_HEADER = 16
+
+// write a large value into overflow pages,
+// returning the first page and the value to store in the leaf
+func (tree *BTree) overflowWrite(val []byte) (uint64, []byte) {
+	size := int(tree.pageSize()) - OVERFLOW_HEADER
+	// written backwards so each page can point to the next one
+	next := uint64(0)
+	for start := (len(val) - 1) / size * size; start >= 0; start -= size {
+		page := make([]byte, tree.pageSize())
+		binary.LittleEndian.PutUint16(page[0:2], BNODE_OVERFLOW)
+		binary.LittleEndian.PutUint64(page[8:16], next)
+		copy(page[OVERFLOW_HEADER:], val[start:])
+		next = tree.new(page)
+	}
+
+	stored := make([]byte, 8)
+	binary.LittleEndian.PutUint64(stored, uint64(len(val)))
+	return next, stored
+}
+
+// the value of a leaf KV, reassembled from its overflow pages if it has any
+// and then decompressed if it was compressed
+func (tree *BTree) leafVal(node BNode, idx uint16) []byte {
+	ptr := node.getPtr(idx)
+	if ptr == 0 {
+		return tree.valDecode(node.getVal(idx))
+	}
+
+	total := int(binary.LittleEndian.Uint64(node.getVal(idx)))
+	val := make([]byte, 0, total)
+	for len(val) < total {
+		utils.Assert(ptr != 0, "overflow chain is too short")
+		page := tree.get(ptr)
+		utils.Assert(binary.LittleEndian.Uint16(page[0:2]) == BNODE_OVERFLOW, "bad overflow page")
+		n := min(total-len(val), len(page)-OVERFLOW_HEADER)
+		val = append(val, page[OVERFLOW_HEADER:][:n]...)
+		ptr = binary.LittleEndian.Uint64(page[8:16])
+	}
+	return tree.valDecode(val)
+}
+
+// copy the value of a leaf KV into dst if it fits, returning its length.
+// only a compressed value is decoded into a new buffer first
+func (tree *BTree) leafValInto(node BNode, idx uint16, dst []byte) int {
+	ptr := node.getPtr(idx)
+	if ptr == 0 || tree.Codec != nil {
+		val := tree.leafVal(node, idx)
+		if len(val) <= len(dst) {
+			copy(dst, val)
+		}
+		return len(val)
+	}
+
+	total := int(binary.LittleEndian.Uint64(node.getVal(idx)))
+	if total > len(dst) {
+		return total
+	}
+	for n := 0; n < total; {
+		utils.Assert(ptr != 0, "overflow chain is too short")
+		page := tree.get(ptr)
+		utils.Assert(binary.LittleEndian.Uint16(page[0:2]) == BNODE_OVERFLOW, "bad overflow page")
+		n += copy(dst[n:total], page[OVERFLOW_HEADER:])
+		ptr = binary.LittleEndian.Uint64(page[8:16])
+	}
+	return total
+}
+
+// deallocate the overflow pages of a value
+func (tree *BTree) overflowFree(ptr uint64) {
+	for ptr != 0 {
+		next := binary.LittleEndian.Uint64(tree.get(ptr)[8:16])
+		tree.del(ptr)
+		ptr = next
+	}
+}
@@ -0,0 +1,51 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the number of overflow pages in the store of a tree
+func overflowPages(tree *BTree) int {
+	n := 0
+	for _, page := range tree.store.(*MemStore).Dump() {
+		if page.btype() == BNODE_OVERFLOW {
+			n++
+		}
+	}
+	return n
+}
+
+func TestOverflowValue(t *testing.T) {
+	tree := NewMemTree()
+	val := make([]byte, 50000)
+	for i := range val {
+		val[i] = byte(i * 31 / 7)
+	}
+	tree.Insert([]byte("a"), []byte("small"))
+	if err := tree.Insert([]byte("big"), val); err != nil {
+		t.Fatal(err)
+	}
+	if n, want := overflowPages(tree), (len(val)+BTREE_PAGE_SIZE-OVERFLOW_HEADER-1)/(BTREE_PAGE_SIZE-OVERFLOW_HEADER); n != want {
+		t.Fatalf("%d overflow pages, want %d", n, want)
+	}
+	if got, ok := tree.Get([]byte("big")); !ok || !bytes.Equal(got, val) {
+		t.Fatalf("%d bytes back, %v", len(got), ok)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// replacing or deleting the value frees its pages
+	tree.Insert([]byte("big"), val[:10000])
+	if got, _ := tree.Get([]byte("big")); !bytes.Equal(got, val[:10000]) || overflowPages(tree) != 3 {
+		t.Fatalf("%d bytes back, %d overflow pages", len(got), overflowPages(tree))
+	}
+	tree.Delete([]byte("big"))
+	if n := overflowPages(tree); n != 0 {
+		t.Fatalf("%d overflow pages left", n)
+	}
+	if got, _ := tree.Get([]byte("a")); string(got) != "small" {
+		t.Fatalf("%q", got)
+	}
+}
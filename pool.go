@@ -0,0 +1,39 @@
+package btree
+
+import (
+	"sync"
+)
+
+// the buffers of the nodes built by insertions and their splits are reused
+// across updates instead of being left to the garbage collector. a buffer
+// can go back to the pool once the node has been allocated, as the new
+// callback copies the node into its own page
+var nodePool sync.Pool // of *[]byte
+
+// borrow a zeroed buffer for a node of size bytes
+func nodeAlloc(tree *BTree, size int) BNode {
+	if buf, ok := nodePool.Get().(*[]byte); ok && cap(*buf) >= size {
+		node := (*buf)[:size]
+		clear(node)
+		return node
+	}
+	// room for the oversized nodes of an insertion
+	return BNode(make([]byte, size, 2*int(tree.pageSize())))
+}
+
+// return the buffer of a node that is no longer used
+func nodeFree(node BNode) {
+	buf := []byte(node[:0])
+	nodePool.Put(&buf)
+}
+
+// return the buffers of a node that was split by nodeSplit3
+// and of its split result, once the result has been allocated
+func nodeSplitFree(old BNode, nsplit uint16, split [3]BNode) {
+	nodeFree(old)
+	if nsplit > 1 {
+		for _, node := range split[:nsplit] {
+			nodeFree(node)
+		}
+	}
+}
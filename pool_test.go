@@ -0,0 +1,55 @@
+package btree
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestNodeAllocZeroed(t *testing.T) {
+	tree := NewMemTree()
+	node := nodeAlloc(tree, BTREE_PAGE_SIZE)
+	for i := range node {
+		node[i] = 0xff
+	}
+	nodeFree(node)
+	for _, size := range []int{BTREE_PAGE_SIZE, 2 * BTREE_PAGE_SIZE, 100} {
+		node := nodeAlloc(tree, size)
+		if len(node) != size {
+			t.Fatalf("%d bytes, want %d", len(node), size)
+		}
+		for i, c := range node {
+			if c != 0 {
+				t.Fatalf("byte %d of a new node is %#x", i, c)
+			}
+		}
+		nodeFree(node)
+	}
+}
+
+// the buffers of an insert are reused, only the pages of the MemStore
+// are allocated: about 3 pages per insert, or 6 more without the pool
+func TestInsertAllocs(t *testing.T) {
+	tree := testTree(20000)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%06d-", i*7919%20000)), []byte("v"))
+	}
+	runtime.ReadMemStats(&after)
+	if n := (after.TotalAlloc - before.TotalAlloc) / 1000; n > 5*BTREE_PAGE_SIZE {
+		t.Fatalf("%d bytes allocated per insert", n)
+	}
+}
+
+func BenchmarkInsertRandom(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tree := testTree(5000)
+		b.StartTimer()
+		for j := 0; j < 5000; j++ {
+			tree.Insert([]byte(fmt.Sprintf("key%06d-", j*7919%5000)), make([]byte, 100))
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package btree
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// prefix compression for leaves (BNODE_PREFIX):
+// the anchor key is stored in full, every key after it is stored as
+// | shared prefix length | suffix |
+// |         2B           |   ...  |
+// the anchor is the first key, or the second one if the first is the dummy
+// key as nothing shares a prefix with it. keys are encoded against keys
+// before them, so nodes of this layout must be built in ascending order.
+// a key inserted in front of the anchor is stored in full rather than
+// becoming the anchor, re-encoding the keys against it could grow the node
+// past what was sized for it. the dummy key then holds the index of the
+// anchor as its value.
+
+// the flags of a new leaf
+func (tree *BTree) leafFlags() uint16 {
+	if tree.PrefixCompression {
+		return BNODE_PREFIX
+	}
+	return 0
+}
+
+// the index of the anchor key
+func (node BNode) anchor() uint16 {
+	pos := node.kvPos(0)
+	if binary.LittleEndian.Uint16(node[pos:]) != 0 || node.nkeys() < 2 {
+		return 0
+	}
+	if int(pos)+6 <= len(node) && binary.LittleEndian.Uint16(node[pos+2:]) == 2 {
+		return min(binary.LittleEndian.Uint16(node[pos+4:]), node.nkeys()-1)
+	}
+	return 1
+}
+
+// the value of the dummy key for an anchor at idx, see anchor
+func anchorVal(idx uint16) []byte {
+	if idx == 1 {
+		return nil
+	}
+	return binary.LittleEndian.AppendUint16(nil, idx)
+}
+
+// the length of the prefix shared by 2 keys
+func sharedPrefix(a []byte, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// the stored form of a key after the anchor
+func prefixSuffix(anchor []byte, key []byte) []byte {
+	plen := sharedPrefix(anchor, key)
+	stored := make([]byte, 2+len(key)-plen)
+	binary.LittleEndian.PutUint16(stored[0:2], uint16(plen))
+	copy(stored[2:], key[plen:])
+	return stored
+}
+
+// returns the size of a node holding the entries [from, to) of a node.
+// keys are re-encoded against the anchor of the range, so the size for a
+// compressed node is computed from the prefix each key would share with it
+func nodeRangeBytes(node BNode) func(from uint16, to uint16) uint16 {
+	if node.flags()&BNODE_PREFIX == 0 {
+		return func(from uint16, to uint16) uint16 {
+			return HEADER + 8*(to-from) + 2*(to-from) + node.getOffset(to) - node.getOffset(from)
+		}
+	}
+
+	// the prefix shared with the anchor is at least the smallest one shared
+	// by the keys in between, exactly that for keys in ascending order
+	keys := make([][]byte, node.nkeys())
+	shared := make([]int, node.nkeys()) // with the previous key
+	sums := make([]int, node.nkeys()+1) // the sizes without the keys
+	for i := range keys {
+		keys[i] = node.getKey(uint16(i))
+		if i > 0 {
+			shared[i] = sharedPrefix(keys[i-1], keys[i])
+		}
+		sums[i+1] = sums[i] + 8 + 2 + 4 + len(node.getVal(uint16(i)))
+	}
+	return func(from uint16, to uint16) uint16 {
+		if from == to {
+			return HEADER
+		}
+		// the anchor as the node would have it
+		anchor := int(from)
+		if len(keys[from]) == 0 && to-from > 1 {
+			anchor++
+			if val := node.getVal(from); len(val) == 2 {
+				anchor = int(from + min(binary.LittleEndian.Uint16(val), to-from-1))
+			}
+		}
+
+		size := HEADER + sums[to] - sums[from]
+		for i := int(from); i <= anchor; i++ {
+			size += len(keys[i])
+		}
+		plen := len(keys[anchor])
+		for i := anchor + 1; i < int(to); i++ {
+			plen = min(plen, shared[i])
+			size += 2 + len(keys[i]) - plen
+		}
+		return uint16(min(size, math.MaxUint16))
+	}
+}
+
+// the size of the node when its entries are copied to another node,
+// same as nbytes() unless the keys are compressed, then it is an upper
+// bound assuming no sharing
+func (node BNode) maxBytes() int {
+	if node.flags()&BNODE_PREFIX == 0 {
+		return int(node.nbytes())
+	}
+	size := HEADER
+	for i := uint16(0); i < node.nkeys(); i++ {
+		size += 8 + 2 + 4 + 2 + len(node.getKey(i)) + len(node.getVal(i))
+	}
+	return size
+}
@@ -0,0 +1,106 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestPrefixCompressionFitsMoreKeys(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("tenant/0001/users/profiles/settings/%06d", i))
+	}
+	fill := func(prefix bool) *BTree {
+		tree := NewMemTree()
+		tree.PrefixCompression = prefix
+		for i := 0; i < 5000; i++ {
+			tree.Insert(key(i*7919%5000), []byte("v"))
+		}
+		return tree
+	}
+	plain, compressed := fill(false), fill(true)
+	for i := 0; i < 5000; i++ {
+		if val, ok := compressed.Get(key(i)); !ok || string(val) != "v" {
+			t.Fatalf("%s: %q %v", key(i), val, ok)
+		}
+	}
+	if err := compressed.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(iterKeys(compressed.Iterate())); n != 5000 {
+		t.Fatalf("%d keys", n)
+	}
+
+	// most of each key is shared with the anchor of its leaf
+	p, c := plain.Stats().Leaves, compressed.Stats().Leaves
+	if 2*c > p {
+		t.Fatalf("%d leaves compressed, %d without", c, p)
+	}
+}
+
+func TestPrefixCompressionInsertBeforeAnchor(t *testing.T) {
+	// the keys of the leftmost leaf share most of their bytes, a smaller key
+	// must not become the anchor they are re-encoded against
+	prefix := strings.Repeat("p", 990)
+	tree := NewMemTree()
+	tree.PrefixCompression = true
+	for i := 0; i < 40; i++ {
+		tree.Insert([]byte(fmt.Sprintf("%s%04d", prefix, i)), nil)
+	}
+	for _, key := range []string{"a", "b", prefix, "0"} {
+		if err := tree.Insert([]byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Verify(); err != nil {
+			t.Fatalf("%.10s: %v", key, err)
+		}
+	}
+	for _, key := range []string{"a", "b", prefix} {
+		if ok, err := tree.Delete([]byte(key)); !ok || err != nil {
+			t.Fatalf("%.10s: %v %v", key, ok, err)
+		}
+		if err := tree.Verify(); err != nil {
+			t.Fatalf("%.10s: %v", key, err)
+		}
+	}
+
+	keys := iterKeys(tree.Iterate())
+	if len(keys) != 41 || string(keys[0]) != "0" {
+		t.Fatalf("%d keys", len(keys))
+	}
+	for i := 0; i < 40; i++ {
+		if _, ok := tree.Get([]byte(fmt.Sprintf("%s%04d", prefix, i))); !ok {
+			t.Fatalf("key %d is missing", i)
+		}
+	}
+}
+
+func TestPrefixCompressionLongSharedKeys(t *testing.T) {
+	// long shared prefixes make the keys much smaller than they would be
+	// re-encoded against another anchor when nodes are split or merged
+	tree := NewMemTree()
+	tree.PrefixCompression = true
+	model := map[string]bool{}
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 6000; i++ {
+		key := fmt.Sprintf("%s%d", strings.Repeat("p", rng.Intn(990)), rng.Intn(50))
+		if rng.Intn(3) == 0 {
+			if ok, err := tree.Delete([]byte(key)); ok != model[key] || err != nil {
+				t.Fatalf("Delete %.10s: %v %v", key, ok, err)
+			}
+			delete(model, key)
+		} else {
+			if err := tree.Insert([]byte(key), make([]byte, rng.Intn(100))); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = true
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != len(model) {
+		t.Fatalf("Len %d, want %d", tree.Len(), len(model))
+	}
+}
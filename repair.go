@@ -0,0 +1,110 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// RepairStats reports what Repair found in the file
+type RepairStats struct {
+	Leaves  int // intact leaves whose KVs were recovered
+	Skipped int // used pages that are internal nodes or damaged
+	Keys    int // recovered keys
+	Lost    int // keys dropped because of a damaged overflow page
+}
+
+// Repair is a last resort for a file whose internal nodes are damaged: it
+// scans every used page for leaves that pass their checksum and bulk loads
+// their KVs into a new in-memory tree, which can then be exported or loaded
+// into a new file. the free list is read to skip the stale leaves of older
+// updates, so it must be intact. keys are assumed to be in the default
+// order, and the values of a tree with a Codec are recovered encoded
+func (store *FileStore) Repair() (*BTree, RepairStats, error) {
+	var stats RepairStats
+	free, err := store.freePages()
+	if err != nil {
+		return nil, stats, fmt.Errorf("read free list: %w", err)
+	}
+	tree, err := NewMemTreeSize(store.pageSize)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	var kvs []KV
+	for ptr := uint64(1); ptr < store.page.flushed; ptr++ {
+		if free[ptr] {
+			continue
+		}
+		page, err := store.cloneRead(ptr)
+		node := BNode(page)
+		if err == nil && (node.btype() == BNODE_OVERFLOW || node.btype() == BNODE_FREE_LIST) {
+			continue // read along with the leaves, or never holding KVs
+		}
+		if err != nil || node.btype() != BNODE_LEAF || node.flags()&^BNODE_PREFIX != 0 ||
+			verifyNode(tree, node) != nil {
+			stats.Skipped++
+			continue
+		}
+
+		stats.Leaves++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if len(key) == 0 {
+				continue // the dummy key
+			}
+			if val, ok := store.repairVal(node, i); ok {
+				kvs = append(kvs, KV{Key: bytes.Clone(key), Val: val})
+			} else {
+				stats.Lost++
+			}
+		}
+	}
+
+	kvs = sortKVs(tree, kvs)
+	stats.Keys = len(kvs)
+	tree.bulkLoad(kvs)
+	return tree, stats, nil
+}
+
+// the pages on the committed free list
+func (store *FileStore) freePages() (map[uint64]bool, error) {
+	fl := &store.committed
+	free := map[uint64]bool{}
+	ptr := fl.headPage
+	node, err := store.cloneRead(ptr)
+	for seq := fl.headSeq; err == nil && seq < fl.tailSeq; seq++ {
+		if seq != fl.headSeq && fl.seq2idx(seq) == 0 {
+			ptr = LNode(node).getNext()
+			node, err = store.cloneRead(ptr)
+			if err != nil {
+				break
+			}
+		}
+		if binary.LittleEndian.Uint16(node[0:2]) != BNODE_FREE_LIST {
+			return nil, fmt.Errorf("page %d: bad free list node", ptr)
+		}
+		free[LNode(node).getPtr(fl.seq2idx(seq))] = true
+	}
+	return free, err
+}
+
+// read the value of a leaf KV like leafVal, failing on damaged overflow pages
+func (store *FileStore) repairVal(node BNode, idx uint16) ([]byte, bool) {
+	ptr := node.getPtr(idx)
+	if ptr == 0 {
+		return bytes.Clone(node.getVal(idx)), true
+	}
+	total := int(binary.LittleEndian.Uint64(node.getVal(idx)))
+	val := make([]byte, 0, total)
+	for len(val) < total {
+		page, err := store.cloneRead(ptr)
+		if err != nil || binary.LittleEndian.Uint16(page[0:2]) != BNODE_OVERFLOW {
+			return nil, false
+		}
+		n := min(total-len(val), len(page)-OVERFLOW_HEADER)
+		val = append(val, page[OVERFLOW_HEADER:][:n]...)
+		ptr = binary.LittleEndian.Uint64(page[8:16])
+	}
+	return val, true
+}
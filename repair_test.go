@@ -0,0 +1,94 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// updated over several commits, which leave stale pages behind
+	for start := 0; start < 5000; start += 500 {
+		var kvs []KV
+		for i := start; i < start+500; i++ {
+			kvs = append(kvs, KV{Key: []byte(fmt.Sprintf("key%04d", i)), Val: make([]byte, 100)})
+		}
+		tree.InsertBatch(kvs)
+	}
+	tree.FilterDelete(func(key []byte, val []byte) bool { return key[len(key)-1]%3 == 0 })
+	tree.Insert([]byte("big1"), bytes.Repeat([]byte("1"), 10000))
+	tree.Insert([]byte("big2"), bytes.Repeat([]byte("2"), 10000))
+	kvs := treeKVs(tree)
+
+	var internal []uint64
+	var big2 uint64 // the first overflow page of a value
+	leaves := 0
+	tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		if node.btype() == BNODE_NODE {
+			internal = append(internal, ptr)
+			return true
+		}
+		leaves++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if string(node.getKey(i)) == "big2" {
+				big2 = node.getPtr(i)
+			}
+		}
+		return true
+	})
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// damage every internal node
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ptr := range internal {
+		fp.WriteAt([]byte{0xff, 0xff}, int64(ptr)*BTREE_PAGE_SIZE+HEADER)
+	}
+	fp.Close()
+
+	tree, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Verify(); err == nil {
+		t.Fatal("the damaged tree verified")
+	}
+	repaired, stats, err := tree.store.(*FileStore).Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RepairStats{Leaves: leaves, Skipped: len(internal), Keys: len(kvs)}
+	if stats != want || !sameKVs(treeKVs(repaired), kvs) {
+		t.Fatalf("%+v, want %+v", stats, want)
+	}
+	if err := repaired.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a value on a damaged overflow page is dropped
+	fp, err = os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteAt([]byte{0xff}, int64(big2)*BTREE_PAGE_SIZE+OVERFLOW_HEADER)
+	fp.Close()
+	repaired, stats, err = tree.store.(*FileStore).Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Lost != 1 || stats.Keys != len(kvs)-1 || repaired.Exists([]byte("big2")) || !repaired.Exists([]byte("big1")) {
+		t.Fatalf("%+v", stats)
+	}
+}
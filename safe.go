@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// SafeTree is a tree that can be used from multiple goroutines.
+// reads run concurrently while updates are serialized.
+// iterators read pages through the store, which is updated by writers,
+// so they must only be used inside View to hold the read lock.
+type SafeTree struct {
+	mu   sync.RWMutex
+	tree *BTree
+}
+
+// Concurrent wraps the tree for concurrent use,
+// the tree must not be used directly afterwards
+func (tree *BTree) Concurrent() *SafeTree {
+	return &SafeTree{tree: tree}
+}
+
+// Get is BTree.Get under the read lock, returning a copy of the value as
+// the page may be reused by a writer once the lock is released.
+// a key in a page failing its checksum is not found and the error is
+// returned by Close
+func (st *SafeTree) Get(key []byte) ([]byte, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	val, ok := st.tree.Get(key)
+	return bytes.Clone(val), ok
+}
+
+func (st *SafeTree) Insert(key []byte, val []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.tree.Insert(key, val)
+}
+
+func (st *SafeTree) InsertBatch(kvs []KV) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.tree.InsertBatch(kvs)
+}
+
+// GetVersion is BTree.GetVersion under the read lock, returning a copy
+// of the value and handling a page failing its checksum as Get does
+func (st *SafeTree) GetVersion(key []byte) ([]byte, uint64, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	val, version, ok := st.tree.GetVersion(key)
+	return bytes.Clone(val), version, ok
+}
+
+// CompareAndSwap is atomic with respect to the other updates of the tree
+func (st *SafeTree) CompareAndSwap(key []byte, val []byte, expected uint64) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.tree.CompareAndSwap(key, val, expected)
+}
+
+// Page returns copies, so the pages stay valid after the lock is released
+func (st *SafeTree) Page(after []byte, limit int) ([]KV, []byte) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.tree.Page(after, limit)
+}
+
+// ScanBatched calls fn with the KVs in key order, up to limit at a time,
+// until it returns false. the read lock is only held while each batch is
+// read, so updates can happen between the batches and the scan is not a
+// consistent view of the tree: a key updated or added after the scan went
+// past it is missed, while one ahead of the scan is seen in its new state
+func (st *SafeTree) ScanBatched(limit int, fn func([]KV) bool) {
+	utils.Assert(limit > 0, "batches of no KVs")
+	var after []byte
+	for {
+		kvs, token := st.Page(after, limit)
+		if len(kvs) == 0 || !fn(kvs) || token == nil {
+			return
+		}
+		after = token
+	}
+}
+
+func (st *SafeTree) Delete(key []byte) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.tree.Delete(key)
+}
+
+// View calls fn with the read lock held, fn must not update the tree
+func (st *SafeTree) View(fn func(tree *BTree)) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	fn(st.tree)
+}
+
+// Update calls fn with the write lock held
+func (st *SafeTree) Update(fn func(tree *BTree) error) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return fn(st.tree)
+}
+
+func (st *SafeTree) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.tree.Close()
+}
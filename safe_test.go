@@ -0,0 +1,135 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// reads and writes from many goroutines, run with -race
+func TestSafeTreeConcurrent(t *testing.T) {
+	st := NewMemTree().Concurrent()
+	for i := 0; i < 500; i++ {
+		st.Insert([]byte(fmt.Sprintf("base%04d", i)), []byte("base"))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				key := []byte(fmt.Sprintf("w%d-%04d", w, i))
+				if err := st.Insert(key, make([]byte, 50)); err != nil {
+					errs <- err
+					return
+				}
+				if i%3 == 0 {
+					st.Delete(key)
+				}
+			}
+		}()
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				key := fmt.Sprintf("base%04d", i*7%500)
+				if val, ok := st.Get([]byte(key)); !ok || string(val) != "base" {
+					errs <- fmt.Errorf("%s: %q %v", key, val, ok)
+					return
+				}
+				if i%50 == 0 {
+					st.View(func(tree *BTree) {
+						n := len(iterKeys(tree.ScanPrefix([]byte("base"))))
+						if err := tree.Verify(); err != nil || n != 500 {
+							errs <- fmt.Errorf("%d base keys: %v", n, err)
+						}
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	st.View(func(tree *BTree) {
+		if tree.Len() != 500+4*200 {
+			t.Fatalf("%d keys", tree.Len())
+		}
+	})
+}
+
+func TestSafeTreeGetCopies(t *testing.T) {
+	tree, err := OpenFile(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := tree.Concurrent()
+	defer st.Close()
+	if err := st.Insert([]byte("key"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	val, _ := st.Get([]byte("key"))
+	versioned, _, _ := st.GetVersion([]byte("key"))
+
+	// the page of the value is freed and reused by the following updates
+	for i := 0; i < 10; i++ {
+		if err := st.Insert([]byte("key"), []byte(fmt.Sprintf("new%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(val) != "old" || string(versioned) != "old" {
+		t.Fatalf("%q %q", val, versioned)
+	}
+}
+
+func TestScanBatched(t *testing.T) {
+	st := NewMemTree().Concurrent()
+	for i := 0; i < 300; i++ {
+		st.Insert([]byte(fmt.Sprintf("key%03d", i)), nil)
+	}
+
+	// a writer goroutine updates the tree between the batches, which would
+	// deadlock if the scan held the lock
+	seen := map[string]bool{}
+	batches := 0
+	st.ScanBatched(100, func(kvs []KV) bool {
+		if len(kvs) > 100 {
+			t.Fatalf("a batch of %d KVs", len(kvs))
+		}
+		for _, kv := range kvs {
+			seen[string(kv.Key)] = true
+		}
+		if batches++; batches == 1 {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				st.Insert([]byte("key050x"), nil) // behind the scan
+				st.Insert([]byte("key150x"), nil) // ahead of it
+				st.Delete([]byte("key250"))
+			}()
+			<-done
+		}
+		return true
+	})
+	if len(seen) != 300 || seen["key050x"] || !seen["key150x"] || seen["key250"] || !seen["key299"] {
+		t.Fatalf("%d keys in %d batches", len(seen), batches)
+	}
+
+	// stopped after the first batch
+	batches = 0
+	st.ScanBatched(100, func(kvs []KV) bool {
+		batches++
+		return false
+	})
+	if batches != 1 {
+		t.Fatalf("%d batches", batches)
+	}
+}
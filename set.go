@@ -0,0 +1,13 @@
+package btree
+
+// the tree as a sorted set: the keys are stored with empty values
+
+// Add inserts a key with an empty value
+func (tree *BTree) Add(key []byte) error {
+	return tree.Insert(key, nil)
+}
+
+// Has reports whether the key is in the tree
+func (tree *BTree) Has(key []byte) bool {
+	return tree.Exists(key)
+}
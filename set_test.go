@@ -0,0 +1,39 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	// the offsets of empty values
+	kvs := testKVs(50, 0)
+	checkNode(t, testNode(BNODE_LEAF, kvs), kvs, nil)
+
+	tree := NewMemTree()
+	for i := 0; i < 5000; i += 2 {
+		if err := tree.Add([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Add([]byte("key0000")); err != nil || tree.Len() != 2500 {
+		t.Fatalf("adding a key twice: %v, %d keys", err, tree.Len())
+	}
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if tree.Has(key) != (i%2 == 0) {
+			t.Fatalf("Has %s is %v", key, tree.Has(key))
+		}
+		if val, ok := tree.Get(key); ok != (i%2 == 0) || len(val) != 0 {
+			t.Fatalf("%s: %q", key, val)
+		}
+	}
+	for iter := tree.Iterate(); iter.Next(); {
+		if len(iter.Val()) != 0 {
+			t.Fatalf("%s: %q", iter.Key(), iter.Val())
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+package btree
+
+import (
+	"errors"
+
+	"github.com/Jeromephilip/go-database/utils"
+)
+
+// Snapshot returns a read-only view of the tree as it is now, which is not
+// affected by later updates. pages are never modified in place, so the
+// snapshot shares all of them with the tree, and the pages freed by updates
+// are only deallocated once every snapshot of the tree has been closed.
+func (tree *BTree) Snapshot() *BTree {
+	if tree.snap.open == 0 {
+		tree.snap.del = tree.del
+		tree.del = func(ptr uint64) {
+			tree.snap.freed = append(tree.snap.freed, ptr)
+		}
+	}
+	tree.snap.open++
+
+	snapshot := newTree(&snapshotStore{tree: tree})
+	snapshot.root, snapshot.count = tree.root, tree.count
+	snapshot.Cmp, snapshot.Codec = tree.Cmp, tree.Codec
+	return snapshot
+}
+
+// the last snapshot is closed, deallocate the pages freed in the meantime
+func (tree *BTree) snapshotRelease() {
+	tree.snap.open--
+	if tree.snap.open > 0 {
+		return
+	}
+
+	tree.del = tree.snap.del
+	for _, ptr := range tree.snap.freed {
+		tree.del(ptr)
+	}
+	tree.snap.del, tree.snap.freed, tree.snap.kept = nil, nil, 0
+}
+
+// called once the update since the last commit is committed or not. the
+// pages freed by a failed update are part of the tree again as the store
+// reverts it, so they must not be deallocated once the snapshots are closed
+func (tree *BTree) snapshotCommitted(ok bool) {
+	if ok {
+		tree.snap.kept = len(tree.snap.freed)
+	} else {
+		tree.snap.freed = tree.snap.freed[:tree.snap.kept]
+	}
+}
+
+// snapshotStore serves the pages of a snapshot from the tree it was taken from
+type snapshotStore struct {
+	tree   *BTree
+	closed bool
+}
+
+func (store *snapshotStore) Get(ptr uint64) []byte {
+	utils.Assert(!store.closed, "use of a closed snapshot")
+	return store.tree.get(ptr)
+}
+
+func (store *snapshotStore) New(node []byte) uint64 {
+	panic("the snapshot is read-only")
+}
+
+func (store *snapshotStore) Del(ptr uint64) {
+	panic("the snapshot is read-only")
+}
+
+func (store *snapshotStore) Commit(tree *BTree) error {
+	return errors.New("the snapshot is read-only")
+}
+
+// Close releases the snapshot, the tree it was taken from stays open
+func (store *snapshotStore) Close() error {
+	if !store.closed {
+		store.closed = true
+		store.tree.snapshotRelease()
+	}
+	return nil
+}
+
+func (store *snapshotStore) PageSize() int {
+	return int(store.tree.pageSize())
+}
@@ -0,0 +1,77 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotFailedCommit(t *testing.T) {
+	tree, err := OpenFile(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	val := make([]byte, 100)
+	for i := 0; i < 1000; i++ {
+		if err := tree.Insert([]byte(fmt.Sprintf("key%04d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := tree.Snapshot()
+	// the pages freed by a failed commit are still part of the tree
+	store := tree.store.(*FileStore)
+	store.readOnly = true
+	if _, err := tree.Delete([]byte("key0500")); err == nil {
+		t.Fatal("the commit didn't fail")
+	}
+	store.readOnly = false
+	snapshot.Close()
+
+	// reuse the free pages
+	for i := 1000; i < 2000; i++ {
+		if err := tree.Insert([]byte(fmt.Sprintf("key%04d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if !tree.Exists([]byte(fmt.Sprintf("key%04d", i))) {
+			t.Fatalf("key%04d is lost", i)
+		}
+	}
+}
+
+func TestSnapshotIsolated(t *testing.T) {
+	tree := testTree(2000)
+	snapshot := tree.Snapshot()
+	defer snapshot.Close()
+
+	for i := 2000; i < 4000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte("new"))
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Delete([]byte(fmt.Sprintf("key%06d", i)))
+	}
+	tree.Insert([]byte("key001500"), []byte("new"))
+
+	if snapshot.Len() != 2000 || tree.Len() != 3000 {
+		t.Fatalf("%d keys in the snapshot, %d in the tree", snapshot.Len(), tree.Len())
+	}
+	keys := iterKeys(snapshot.Iterate())
+	if len(keys) != 2000 || keys[0] != "key000000" || keys[1999] != "key001999" {
+		t.Fatalf("%d keys in the snapshot", len(keys))
+	}
+	if val, _ := snapshot.Get([]byte("key001500")); len(val) != 100 {
+		t.Fatalf("the snapshot sees the update %q", val)
+	}
+	if snapshot.Exists([]byte("key002000")) {
+		t.Fatal("the snapshot sees an insert")
+	}
+	if err := snapshot.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
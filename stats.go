@@ -0,0 +1,88 @@
+package btree
+
+// WalkNodes calls fn on every node of the tree in pre-order, with the root
+// at depth 0. the kids of a node are skipped if fn returns false for it.
+// overflow pages are not visited
+func (tree *BTree) WalkNodes(fn func(ptr uint64, node BNode, depth int) bool) {
+	defer tree.recoverChecksum()
+	if tree.root != 0 {
+		tree.walkNodes(tree.root, 0, fn)
+	}
+}
+
+func (tree *BTree) walkNodes(ptr uint64, depth int, fn func(uint64, BNode, int) bool) {
+	node := BNode(tree.get(ptr))
+	if !fn(ptr, node, depth) || node.btype() != BNODE_NODE {
+		return
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		tree.walkNodes(node.getPtr(i), depth+1, fn)
+	}
+}
+
+// the shape of a tree as reported by Stats
+type TreeStats struct {
+	Height int     // number of levels, 0 for an empty tree
+	Nodes  int     // total number of nodes
+	Leaves int     // number of leaf nodes
+	Keys   int     // number of keys, not counting the dummy key
+	Fill   float64 // the average of nbytes() over the page size of all nodes
+}
+
+// Stats walks the whole tree and reports its shape
+func (tree *BTree) Stats() TreeStats {
+	var stats TreeStats
+	if tree.root == 0 {
+		return stats
+	}
+
+	var used int
+	tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		stats.Nodes++
+		used += int(node.nbytes())
+		stats.Height = max(stats.Height, depth+1)
+
+		switch node.btype() {
+		case BNODE_LEAF:
+			stats.Leaves++
+			stats.Keys += int(node.nkeys())
+		case BNODE_NODE:
+			// the kids are visited next
+		default:
+			panic("bad node!")
+		}
+		return true
+	})
+
+	stats.Keys-- // the dummy key
+	stats.Fill = float64(used) / float64(stats.Nodes*int(tree.pageSize()))
+	return stats
+}
+
+// the layout of a single node as reported by NodeInfo
+type NodeInfo struct {
+	Type      uint16 // BNODE_NODE or BNODE_LEAF
+	Keys      int
+	Used      int  // nbytes()
+	Free      int  // the page size minus the used bytes, negative if overfull
+	Underfull bool // smaller than the size set by MergeFill, it's merged on deletion
+	Overfull  bool // the node doesn't fit in a page
+}
+
+// NodeInfo inspects the node at ptr
+func (tree *BTree) NodeInfo(ptr uint64) NodeInfo {
+	defer tree.recoverChecksum()
+	return nodeInfo(tree, BNode(tree.get(ptr)))
+}
+
+func nodeInfo(tree *BTree, node BNode) NodeInfo {
+	pageSize, used := int(tree.pageSize()), int(node.nbytes())
+	return NodeInfo{
+		Type:      node.btype(),
+		Keys:      int(node.nkeys()),
+		Used:      used,
+		Free:      pageSize - used,
+		Underfull: used < int(tree.mergeBytes()),
+		Overfull:  used > pageSize,
+	}
+}
@@ -0,0 +1,105 @@
+package btree
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	if stats := NewMemTree().Stats(); stats != (TreeStats{}) {
+		t.Fatalf("empty tree: %+v", stats)
+	}
+
+	tree := testLeafTree(3, 3, 33)
+	used := 0
+	for _, page := range tree.store.(*MemStore).Dump() {
+		used += int(page.nbytes())
+	}
+	stats := tree.Stats()
+	want := TreeStats{Height: 2, Nodes: 4, Leaves: 3, Keys: 38, Fill: float64(used) / (4 * BTREE_PAGE_SIZE)}
+	if stats != want {
+		t.Fatalf("%+v, want %+v", stats, want)
+	}
+}
+
+func TestNodeInfo(t *testing.T) {
+	tree := NewMemTree()
+	// a KV of testKVs takes 8+2+4+5 bytes and its value
+	for _, c := range []struct {
+		n, vlen int
+		want    NodeInfo
+	}{
+		{3, 10, NodeInfo{BNODE_LEAF, 3, 95, 4001, true, false}},
+		{20, 81, NodeInfo{BNODE_LEAF, 20, 2008, 2088, true, false}},
+		{20, 83, NodeInfo{BNODE_LEAF, 20, 2048, 2048, false, false}},
+		{34, 100, NodeInfo{BNODE_LEAF, 34, 4054, 42, false, false}},
+		{40, 100, NodeInfo{BNODE_LEAF, 40, 4768, -672, false, true}},
+	} {
+		node := testNode(BNODE_LEAF, testKVs(c.n, c.vlen))
+		if got := nodeInfo(tree, node); got != c.want {
+			t.Fatalf("%d KVs of %d bytes: %+v, want %+v", c.n, c.vlen, got, c.want)
+		}
+	}
+	// underfull as deletions see it
+	tree.MergeFill = 0.25
+	if info := nodeInfo(tree, testNode(BNODE_LEAF, testKVs(20, 81))); info.Underfull {
+		t.Fatalf("MergeFill %v: %+v", tree.MergeFill, info)
+	}
+	if info := nodeInfo(tree, testNode(BNODE_LEAF, testKVs(3, 10))); !info.Underfull {
+		t.Fatalf("MergeFill %v: %+v", tree.MergeFill, info)
+	}
+
+	tree = testLeafTree(3, 3, 33)
+	root := BNode(tree.get(tree.root))
+	if info := tree.NodeInfo(tree.root); info.Type != BNODE_NODE || info.Keys != 3 || info.Used != int(root.nbytes()) {
+		t.Fatalf("root: %+v", info)
+	}
+	if info := tree.NodeInfo(root.getPtr(2)); info.Type != BNODE_LEAF || info.Keys != 33 || info.Underfull {
+		t.Fatalf("last leaf: %+v", info)
+	}
+}
+
+func TestWalkNodes(t *testing.T) {
+	tree := testLeafTree(3, 3, 33)
+	root := BNode(tree.get(tree.root))
+	var ptrs []uint64
+	var depths []int
+	tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		ptrs, depths = append(ptrs, ptr), append(depths, depth)
+		return true
+	})
+	// the root then its kids in order
+	want := []uint64{tree.root, root.getPtr(0), root.getPtr(1), root.getPtr(2)}
+	if len(ptrs) != 4 || ptrs[0] != want[0] || ptrs[1] != want[1] || ptrs[2] != want[2] || ptrs[3] != want[3] {
+		t.Fatalf("visited %v, want %v", ptrs, want)
+	}
+	if depths[0] != 0 || depths[1] != 1 || depths[2] != 1 || depths[3] != 1 {
+		t.Fatalf("depths %v", depths)
+	}
+
+	// the nodes of each level of a 3-level tree, and the kids of the
+	// nodes returning false are skipped
+	tree = testTree(20000)
+	perDepth := map[int]int{}
+	kids := map[int]int{}
+	tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		perDepth[depth]++
+		if node.btype() == BNODE_NODE {
+			kids[depth+1] += int(node.nkeys())
+		}
+		return true
+	})
+	stats := tree.Stats()
+	if stats.Height != 3 || perDepth[0] != 1 || perDepth[1] != kids[1] || perDepth[2] != kids[2] || perDepth[2] != stats.Leaves {
+		t.Fatalf("%v nodes per depth, %v kids, %+v", perDepth, kids, stats)
+	}
+	n := 0
+	tree.WalkNodes(func(ptr uint64, node BNode, depth int) bool {
+		n++
+		return depth == 0
+	})
+	if n != 1+kids[1] {
+		t.Fatalf("%d nodes visited, want %d", n, 1+kids[1])
+	}
+	NewMemTree().WalkNodes(func(uint64, BNode, int) bool {
+		t.Fatal("a node in an empty tree")
+		return false
+	})
+}
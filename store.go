@@ -0,0 +1,39 @@
+package btree
+
+// Store is the page storage behind a tree. the tree reaches the pages
+// through its get/new/del callbacks, which newTree wires to the store.
+type Store interface {
+	Get(ptr uint64) []byte  // dereference a pointer
+	New(node []byte) uint64 // allocate a new page, copying the node
+	Del(ptr uint64)         // deallocate a page
+	// persist the pages of an update to the tree
+	Commit(tree *BTree) error
+	Close() error
+	PageSize() int // the size of every page in bytes
+}
+
+func newTree(store Store) *BTree {
+	return &BTree{
+		get: store.Get, new: store.New, del: store.Del,
+		store: store, psize: uint16(store.PageSize()),
+	}
+}
+
+// persist the tree after an update
+func (tree *BTree) commit() error {
+	tree.mods++
+	if tree.store == nil {
+		return nil
+	}
+	err := tree.store.Commit(tree)
+	tree.snapshotCommitted(err == nil)
+	return err
+}
+
+// Close flushes and releases the store behind the tree
+func (tree *BTree) Close() error {
+	if tree.store == nil {
+		return nil
+	}
+	return tree.store.Close()
+}
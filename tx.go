@@ -0,0 +1,106 @@
+package btree
+
+import (
+	"errors"
+)
+
+// Tx groups updates to a tree which are applied all at once or not at all.
+// the updates are made on a private root which replaces the root of the
+// tree on commit. the pages freed by the updates are only deallocated on
+// commit, while the new pages are deallocated on rollback.
+// the tree must not be updated directly while a transaction is open.
+type Tx struct {
+	tree    *BTree
+	pending *BTree              // the tree as seen by the transaction
+	pages   map[uint64]struct{} // pages allocated by the transaction
+	freed   []uint64            // pages of the tree freed by the transaction
+	done    bool
+}
+
+// Begin starts a transaction on the tree
+func (tree *BTree) Begin() *Tx {
+	tx := &Tx{tree: tree, pages: map[uint64]struct{}{}}
+	tx.pending = &BTree{
+		root: tree.root, get: tree.get, new: tx.new, del: tx.del,
+		psize: tree.psize, count: tree.count,
+		PrefixCompression: tree.PrefixCompression, SubtreeCounts: tree.SubtreeCounts,
+		SplitPolicy: tree.SplitPolicy, MergeFill: tree.MergeFill,
+		Cmp: tree.Cmp, Codec: tree.Codec, obs: tree.obs,
+	}
+	return tx
+}
+
+func (tx *Tx) new(node []byte) uint64 {
+	ptr := tx.tree.new(node)
+	tx.pages[ptr] = struct{}{}
+	return ptr
+}
+
+func (tx *Tx) del(ptr uint64) {
+	if _, ok := tx.pages[ptr]; ok {
+		// not reachable from the tree, it can go right away
+		delete(tx.pages, ptr)
+		tx.tree.del(ptr)
+		return
+	}
+	tx.freed = append(tx.freed, ptr)
+}
+
+var errTxDone = errors.New("the transaction is already committed or rolled back")
+
+// Insert adds a KV within the transaction
+func (tx *Tx) Insert(key []byte, val []byte) error {
+	if tx.done {
+		return errTxDone
+	}
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	tx.pending.insert(key, val, MODE_UPSERT)
+	return nil
+}
+
+// Delete removes a key within the transaction
+func (tx *Tx) Delete(key []byte) bool {
+	if tx.done {
+		return false
+	}
+	return tx.pending.delete(key)
+}
+
+// Get looks up a key, seeing the updates of the transaction
+func (tx *Tx) Get(key []byte) ([]byte, bool) {
+	defer tx.tree.recoverChecksum()
+	return tx.pending.Get(key)
+}
+
+// Commit applies the updates of the transaction to the tree
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	tx.apply()
+	return tx.tree.commit()
+}
+
+// replace the tree with the pending one, without committing it
+func (tx *Tx) apply() {
+	for _, ptr := range tx.freed {
+		tx.tree.del(ptr)
+	}
+	tx.tree.root, tx.tree.count = tx.pending.root, tx.pending.count
+	tx.tree.mods++
+}
+
+// Rollback discards the updates of the transaction
+func (tx *Tx) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+
+	for ptr := range tx.pages {
+		tx.tree.del(ptr)
+	}
+}
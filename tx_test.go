@@ -0,0 +1,60 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTxRollback(t *testing.T) {
+	tree := testTree(1000)
+	hash := tree.ContentHash()
+	tx := tree.Begin()
+	for i := 1000; i < 2000; i++ {
+		if err := tx.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Delete([]byte("key000000"))
+	if val, ok := tx.Get([]byte("key001500")); !ok || string(val) != "new" {
+		t.Fatalf("the transaction doesn't see its insert: %q %v", val, ok)
+	}
+	if tree.Exists([]byte("key001500")) || !tree.Exists([]byte("key000000")) {
+		t.Fatal("the tree sees the transaction before its commit")
+	}
+
+	tx.Rollback()
+	if string(tree.ContentHash()) != string(hash) || tree.Len() != 1000 {
+		t.Fatalf("the tree changed, %d keys", tree.Len())
+	}
+	checkNoLeak(t, tree)
+	if tx.Insert([]byte("a"), nil) == nil || tx.Commit() == nil {
+		t.Fatal("used a rolled back transaction")
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	tree := testTree(1000)
+	tx := tree.Begin()
+	for i := 1000; i < 2000; i++ {
+		tx.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte("new"))
+	}
+	for i := 0; i < 500; i++ {
+		tx.Delete([]byte(fmt.Sprintf("key%06d", i)))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tree.Len() != 1500 || tree.Exists([]byte("key000499")) {
+		t.Fatalf("%d keys", tree.Len())
+	}
+	for i := 1000; i < 2000; i++ {
+		if val, ok := tree.Get([]byte(fmt.Sprintf("key%06d", i))); !ok || string(val) != "new" {
+			t.Fatalf("key%06d: %q %v", i, val, ok)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLeak(t, tree)
+}
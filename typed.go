@@ -0,0 +1,76 @@
+package btree
+
+// TypedTree wraps a tree with encoders between its keys and values and
+// Go types. the key encoding must preserve the order, i.e. the encoded keys
+// must compare (byte by byte, or with the Cmp of the tree) like the keys
+// themselves, or iterations and ranges come out scrambled. for integers,
+// EncodeUint64 does so while a little-endian encoding doesn't
+type TypedTree[K any, V any] struct {
+	tree      *BTree
+	encodeKey func(K) []byte
+	decodeKey func([]byte) K
+	encodeVal func(V) []byte
+	decodeVal func([]byte) V
+}
+
+// NewTypedTree wraps a tree whose keys and values are all made by the encoders
+func NewTypedTree[K any, V any](
+	tree *BTree,
+	encodeKey func(K) []byte, decodeKey func([]byte) K,
+	encodeVal func(V) []byte, decodeVal func([]byte) V,
+) *TypedTree[K, V] {
+	return &TypedTree[K, V]{
+		tree:      tree,
+		encodeKey: encodeKey, decodeKey: decodeKey,
+		encodeVal: encodeVal, decodeVal: decodeVal,
+	}
+}
+
+// Tree returns the underlying tree
+func (tt *TypedTree[K, V]) Tree() *BTree {
+	return tt.tree
+}
+
+func (tt *TypedTree[K, V]) Insert(key K, val V) error {
+	return tt.tree.Insert(tt.encodeKey(key), tt.encodeVal(val))
+}
+
+func (tt *TypedTree[K, V]) Get(key K) (V, bool) {
+	val, ok := tt.tree.Get(tt.encodeKey(key))
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return tt.decodeVal(val), true
+}
+
+func (tt *TypedTree[K, V]) Delete(key K) (bool, error) {
+	return tt.tree.Delete(tt.encodeKey(key))
+}
+
+// TypedIter is an Iter decoding the KVs at the cursor
+type TypedIter[K any, V any] struct {
+	*Iter
+	tt *TypedTree[K, V]
+}
+
+// Iterate returns a cursor positioned before the first KV, see BTree.Iterate
+func (tt *TypedTree[K, V]) Iterate() *TypedIter[K, V] {
+	return &TypedIter[K, V]{Iter: tt.tree.Iterate(), tt: tt}
+}
+
+// Range returns a cursor over the KVs between start and end, see BTree.Range
+func (tt *TypedTree[K, V]) Range(start K, end K, bound RangeBound) *TypedIter[K, V] {
+	iter := tt.tree.Range(tt.encodeKey(start), tt.encodeKey(end), bound)
+	return &TypedIter[K, V]{Iter: iter, tt: tt}
+}
+
+// Key returns the decoded key at the cursor
+func (iter *TypedIter[K, V]) Key() K {
+	return iter.tt.decodeKey(iter.Iter.Key())
+}
+
+// Val returns the decoded value at the cursor
+func (iter *TypedIter[K, V]) Val() V {
+	return iter.tt.decodeVal(iter.Iter.Val())
+}
@@ -0,0 +1,64 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+// an int-keyed tree of strings. flipping the sign bit orders the negative
+// keys before the others
+func intStringTree() *TypedTree[int, string] {
+	return NewTypedTree(NewMemTree(),
+		func(key int) []byte { return EncodeUint64(uint64(key) ^ 1<<63) },
+		func(key []byte) int {
+			x, err := DecodeUint64(key)
+			if err != nil {
+				panic(err)
+			}
+			return int(x ^ 1<<63)
+		},
+		func(val string) []byte { return []byte(val) },
+		func(val []byte) string { return string(val) },
+	)
+}
+
+func TestTypedTree(t *testing.T) {
+	tt := intStringTree()
+	for _, key := range []int{5, -3, 1000, 0, -1 << 40, 42} {
+		if err := tt.Insert(key, fmt.Sprint("v", key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, ok := tt.Get(-3); !ok || val != "v-3" {
+		t.Fatalf("Get: %q %v", val, ok)
+	}
+	if val, ok := tt.Get(7); ok || val != "" {
+		t.Fatalf("absent key: %q %v", val, ok)
+	}
+
+	var keys []int
+	for iter := tt.Iterate(); iter.Next(); {
+		if iter.Val() != fmt.Sprint("v", iter.Key()) {
+			t.Fatalf("%d: %q", iter.Key(), iter.Val())
+		}
+		keys = append(keys, iter.Key())
+	}
+	if fmt.Sprint(keys) != fmt.Sprint([]int{-1 << 40, -3, 0, 5, 42, 1000}) {
+		t.Fatalf("keys %v", keys)
+	}
+
+	keys = nil
+	for iter := tt.Range(-3, 42, RANGE_EXCLUDE_END); iter.Next(); {
+		keys = append(keys, iter.Key())
+	}
+	if fmt.Sprint(keys) != "[-3 0 5]" {
+		t.Fatalf("range %v", keys)
+	}
+
+	if ok, _ := tt.Delete(0); !ok {
+		t.Fatal("Delete")
+	}
+	if ok, _ := tt.Delete(0); ok || tt.Tree().Len() != 5 {
+		t.Fatalf("%d keys after Delete", tt.Tree().Len())
+	}
+}
@@ -1,7 +1,7 @@
 package utils
 
 func Assert(b bool, message string) {
-	if b {
+	if !b {
 		panic(message)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,140 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Verify walks every node and checks the invariants of the tree,
+// returning the first violation found along with the offending page,
+// or the page failing its checksum for a file-backed tree
+func (tree *BTree) Verify() (err error) {
+	if tree.root == 0 {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = checksumPanic(r)
+		}
+	}()
+
+	height, count := -1, 0
+	var walk func(ptr uint64, depth int, first []byte, next []byte) error
+	walk = func(ptr uint64, depth int, first []byte, next []byte) error {
+		node := BNode(tree.get(ptr))
+		if err := verifyNode(tree, node); err != nil {
+			return fmt.Errorf("page %d: %w", ptr, err)
+		}
+		if !bytes.Equal(node.getKey(0), first) {
+			return fmt.Errorf("page %d: first key %q doesn't match the parent key %q", ptr, node.getKey(0), first)
+		}
+		if next != nil && tree.compare(node.getKey(node.nkeys()-1), next) >= 0 {
+			return fmt.Errorf("page %d: last key %q is not less than the next parent key %q", ptr, node.getKey(node.nkeys()-1), next)
+		}
+
+		if node.btype() == BNODE_LEAF {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				if node.getPtr(i) != 0 && len(node.getVal(i)) != 8 {
+					return fmt.Errorf("page %d: bad overflow value at KV %d", ptr, i)
+				}
+			}
+			count += int(node.nkeys())
+			if height < 0 {
+				height = depth
+			} else if depth != height {
+				return fmt.Errorf("page %d: leaf at depth %d, expected %d", ptr, depth, height)
+			}
+			return nil
+		}
+
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kidNext := next
+			if i+1 < node.nkeys() {
+				kidNext = node.getKey(i + 1)
+			}
+			before := count
+			if err := walk(node.getPtr(i), depth+1, node.getKey(i), kidNext); err != nil {
+				return err
+			}
+			if node.flags()&BNODE_COUNTS == 0 {
+				continue
+			}
+			kid := BNode(tree.get(node.getPtr(i)))
+			if kid.btype() == BNODE_NODE && kid.flags()&BNODE_COUNTS == 0 {
+				return fmt.Errorf("page %d: kid %d has no key counts", ptr, i)
+			}
+			if n := binary.LittleEndian.Uint64(node.getVal(i)); n != uint64(count-before) {
+				return fmt.Errorf("page %d: key count %d of kid %d, it has %d keys", ptr, n, i, count-before)
+			}
+		}
+		return nil
+	}
+
+	root := BNode(tree.get(tree.root))
+	if root.btype() == BNODE_NODE && root.nkeys() == 1 {
+		return fmt.Errorf("page %d: the root has a single kid", tree.root)
+	}
+	// the root starts with the dummy key
+	if err := walk(tree.root, 0, nil, nil); err != nil {
+		return err
+	}
+	if count-1 != tree.count {
+		return fmt.Errorf("key count is %d, the tree has %d keys", tree.count, count-1)
+	}
+	return nil
+}
+
+// check the layout of a single node
+func verifyNode(tree *BTree, node BNode) error {
+	if btype := node.btype(); btype != BNODE_NODE && btype != BNODE_LEAF {
+		return fmt.Errorf("bad node type %d", btype)
+	}
+	pageSize := int(tree.pageSize())
+	nkeys := node.nkeys()
+	if nkeys == 0 {
+		return fmt.Errorf("empty node")
+	}
+	if HEADER+10*int(nkeys) > pageSize {
+		return fmt.Errorf("%d keys don't fit in a page", nkeys)
+	}
+
+	// the offset array must agree with the KVs it points to
+	for i := uint16(0); i < nkeys; i++ {
+		pos := int(node.kvPos(i))
+		if pos+4 > pageSize {
+			return fmt.Errorf("KV %d is out of the page", i)
+		}
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node[pos+2:]))
+		end := int(node.kvPos(0)) + int(node.getOffset(i+1))
+		if pos+4+klen+vlen != end {
+			return fmt.Errorf("offset %d doesn't match the size of KV %d", i+1, i)
+		}
+		if end > pageSize {
+			return fmt.Errorf("node is greater than the page size")
+		}
+	}
+	if node.btype() == BNODE_NODE && node.flags()&^BNODE_COUNTS != 0 {
+		return fmt.Errorf("internal node with flags %#x", node.flags())
+	}
+	if node.btype() == BNODE_NODE && node.flags()&BNODE_COUNTS != 0 {
+		for i := uint16(0); i < nkeys; i++ {
+			if len(node.getVal(i)) != 8 {
+				return fmt.Errorf("bad key count at KV %d", i)
+			}
+		}
+	}
+
+	for i := uint16(0); i < nkeys; i++ {
+		if _, err := node.checkedKey(i); err != nil {
+			return err
+		}
+	}
+	for i := uint16(1); i < nkeys; i++ {
+		if tree.compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+			return fmt.Errorf("key %d is not sorted", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package btree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	if err := NewMemTree().Verify(); err != nil {
+		t.Fatalf("empty tree: %v", err)
+	}
+	if err := testTree(5000).Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyCorrupted(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		corrupt func(tree *BTree, root BNode, leaf BNode)
+		onLeaf  bool // the error names the page of the leaf
+		want    string
+	}{
+		{"unsorted keys", func(tree *BTree, root BNode, leaf BNode) {
+			leaf.getKey(2)[5] = '0' // key005 -> key000
+		}, true, "key 2 is not sorted"},
+		{"bad offset", func(tree *BTree, root BNode, leaf BNode) {
+			leaf.setOffset(1, leaf.getOffset(1)+1)
+		}, true, "doesn't match the size"},
+		{"parent key", func(tree *BTree, root BNode, leaf BNode) {
+			root.getKey(1)[5] = '4' // key003 -> key004
+		}, true, "doesn't match the parent key"},
+		{"overflow pointer", func(tree *BTree, root BNode, leaf BNode) {
+			leaf.setPtr(1, 1)
+		}, true, "bad overflow value"},
+		{"key count", func(tree *BTree, root BNode, leaf BNode) {
+			tree.count++
+		}, false, "key count is 39"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tree := testLeafTree(3, 3, 33)
+			root := BNode(tree.get(tree.root))
+			c.corrupt(tree, root, tree.get(root.getPtr(1)))
+			err := tree.Verify()
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("%v, want %q", err, c.want)
+			}
+			if page := fmt.Sprintf("page %d:", root.getPtr(1)); c.onLeaf && !strings.HasPrefix(err.Error(), page) {
+				t.Fatalf("%v, want it on %s", err, page)
+			}
+		})
+	}
+}
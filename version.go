@@ -0,0 +1,38 @@
+package btree
+
+import (
+	"encoding/binary"
+)
+
+// versioned values carry a write counter for optimistic concurrency:
+// | version | val |
+// |   8B    | ... |
+// a key written by CompareAndSwap must only be read with GetVersion and
+// written with CompareAndSwap, as Get and Insert see the raw encoding.
+// a missing key is at version 0
+
+// GetVersion looks up a versioned value and its version
+func (tree *BTree) GetVersion(key []byte) ([]byte, uint64, bool) {
+	data, ok := tree.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	if len(data) < 8 {
+		return data, 0, true // not a versioned value
+	}
+	return data[8:], binary.LittleEndian.Uint64(data), true
+}
+
+// CompareAndSwap sets the value of the key if it's still at the expected
+// version, bumping the version. it returns false if another write got there
+// first, in which case GetVersion returns the current version to retry with
+func (tree *BTree) CompareAndSwap(key []byte, val []byte, expected uint64) bool {
+	if _, version, _ := tree.GetVersion(key); version != expected {
+		return false
+	}
+
+	data := make([]byte, 8+len(val))
+	binary.LittleEndian.PutUint64(data, expected+1)
+	copy(data[8:], val)
+	return tree.Insert(key, data) == nil
+}
@@ -0,0 +1,55 @@
+package btree
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	tree := NewMemTree()
+	if _, version, ok := tree.GetVersion([]byte("a")); ok || version != 0 {
+		t.Fatalf("missing key at version %d", version)
+	}
+	if !tree.CompareAndSwap([]byte("a"), []byte("v1"), 0) {
+		t.Fatal("creating the key failed")
+	}
+	val, version, _ := tree.GetVersion([]byte("a"))
+	if string(val) != "v1" || version != 1 {
+		t.Fatalf("%q at version %d", val, version)
+	}
+
+	// another writer bumps the version between the read and the swap
+	if !tree.CompareAndSwap([]byte("a"), []byte("v2"), version) {
+		t.Fatal("the concurrent swap failed")
+	}
+	if tree.CompareAndSwap([]byte("a"), []byte("stale"), version) {
+		t.Fatal("a swap at a stale version succeeded")
+	}
+	if val, version, _ := tree.GetVersion([]byte("a")); string(val) != "v2" || version != 2 {
+		t.Fatalf("%q at version %d", val, version)
+	}
+}
+
+// increments from many goroutines through a SafeTree, retrying on conflict
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	st := NewMemTree().Concurrent()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				for {
+					val, version, _ := st.GetVersion([]byte("counter"))
+					if st.CompareAndSwap([]byte("counter"), append(val, 'x'), version) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, version, _ := st.GetVersion([]byte("counter")); len(val) != 800 || version != 800 {
+		t.Fatalf("%d bytes at version %d", len(val), version)
+	}
+}
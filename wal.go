@@ -0,0 +1,123 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// the write-ahead log of the file store protects the file against a crash
+// in the middle of a commit. before anything is written into the file, the
+// pages of the update and the new meta page are written into the log and
+// made durable, and the log is cleared once the update is in the file.
+// on open, a complete log is replayed into the file, while an incomplete
+// one is discarded since the file wasn't touched yet.
+//
+// | ptr | page | ... | ptr | page | sig | nrecords | checksum |
+// | 8B  | ...  |     | 8B  | ...  | 16B |    8B    |    4B    |
+const WAL_SIG = "go-database.wal\x00"
+
+const WAL_TRAILER = 28
+
+// log the pending pages and the meta page pointing to the new root.
+// the pages are final at this point, so their checksums are also set here
+func (store *FileStore) walWrite(root uint64, count int) error {
+	if _, err := store.wal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek WAL: %w", err)
+	}
+	if err := store.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+
+	bw := bufio.NewWriter(store.wal)
+	crc := crc32.NewIEEE()
+	w := io.MultiWriter(bw, crc)
+	var nrecords uint64
+	record := func(ptr uint64, page []byte) {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], ptr)
+		w.Write(buf[:])
+		w.Write(page)
+		nrecords++
+	}
+
+	for i, page := range store.page.temp {
+		setPageChecksum(page)
+		record(store.page.flushed+uint64(i), page)
+	}
+	for ptr, page := range store.page.updates {
+		setPageChecksum(page)
+		record(ptr, page)
+	}
+	used := store.page.flushed + uint64(len(store.page.temp))
+	meta := make([]byte, store.pageSize)
+	copy(meta, metaData(store, root, count, used))
+	record(0, meta)
+
+	var trailer [WAL_TRAILER]byte
+	copy(trailer[:16], WAL_SIG)
+	binary.LittleEndian.PutUint64(trailer[16:], nrecords)
+	w.Write(trailer[:24])
+	binary.LittleEndian.PutUint32(trailer[24:], crc.Sum32())
+	bw.Write(trailer[24:])
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write WAL: %w", err)
+	}
+	if err := store.wal.Sync(); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	return nil
+}
+
+// clear the log once its update is in the file
+func (store *FileStore) walReset() error {
+	if err := store.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+	if err := store.wal.Sync(); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	return nil
+}
+
+// replay the log left by a commit interrupted by a crash
+func (store *FileStore) recover() error {
+	data, err := os.ReadFile(store.path + ".wal")
+	if errors.Is(err, os.ErrNotExist) && store.readOnly {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read WAL: %w", err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	size := 8 + store.pageSize
+	n := len(data) - WAL_TRAILER
+	complete := n >= 0 && n%size == 0 &&
+		string(data[n:n+16]) == WAL_SIG &&
+		binary.LittleEndian.Uint64(data[n+16:]) == uint64(n/size) &&
+		binary.LittleEndian.Uint32(data[n+24:]) == crc32.ChecksumIEEE(data[:n+24])
+	if complete && store.readOnly {
+		return errors.New("the WAL holds an interrupted commit, the file must be opened for writing to recover it")
+	} else if store.readOnly {
+		return nil // the file wasn't touched by the incomplete commit
+	}
+	if complete {
+		for pos := 0; pos < n; pos += size {
+			ptr := binary.LittleEndian.Uint64(data[pos:])
+			if _, err := store.fp.WriteAt(data[pos+8:pos+size], int64(ptr)*int64(store.pageSize)); err != nil {
+				return fmt.Errorf("replay WAL: %w", err)
+			}
+		}
+		if err := store.fp.Sync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+	}
+	return store.walReset()
+}
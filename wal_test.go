@@ -0,0 +1,88 @@
+package btree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the files of a tree crashing right after logging an update of 1000 new
+// keys, before anything was written into the file
+func walCrash(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db")
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100))
+	}
+	for i := 1000; i < 2000; i++ {
+		tree.insert([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100), MODE_UPSERT)
+	}
+	if err := tree.store.(*FileStore).walWrite(tree.root, tree.count); err != nil {
+		t.Fatal(err)
+	}
+
+	crash := filepath.Join(dir, "crash")
+	for _, ext := range []string{"", ".wal"} {
+		data, err := os.ReadFile(path + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(crash+ext, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.Close()
+	return crash
+}
+
+// reopen a crashed tree and check it holds n keys
+func checkRecovered(t *testing.T, path string, n int) {
+	t.Helper()
+	tree, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != n || len(iterKeys(tree.Iterate())) != n {
+		t.Fatalf("%d keys, want %d", tree.Len(), n)
+	}
+	if info, err := os.Stat(path + ".wal"); err != nil || info.Size() != 0 {
+		t.Fatalf("the WAL is not cleared: %v", err)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	path := walCrash(t)
+	// a torn write of the meta page
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteAt(make([]byte, 24), 24)
+	fp.Close()
+
+	checkRecovered(t, path, 2000)
+}
+
+func TestWALIncomplete(t *testing.T) {
+	path := walCrash(t)
+	// the crash happened while writing the log, the file is untouched
+	info, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path+".wal", info.Size()-100); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRecovered(t, path, 1000)
+}